@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/cthulhu-platform/common/pkg/env"
 	"github.com/cthulhu-platform/gateway/internal/microservices"
@@ -67,6 +68,15 @@ func main() {
 	authService := auth.NewLocalAuthService(sc)
 	diagnoseService := diagnose.NewLocalDiagnoseService(sc)
 
+	// Background reaper for expired buckets, stopped when main returns
+	reaperInterval, err := time.ParseDuration(pkg.BUCKET_REAPER_INTERVAL)
+	if err != nil || reaperInterval <= 0 {
+		reaperInterval = time.Minute // Default
+	}
+	reaperCtx, stopReaper := context.WithCancel(ctx)
+	defer stopReaper()
+	go file.RunBucketReaper(reaperCtx, fileService, reaperInterval)
+
 	// Initialize Server and inject dependencies
 	config := &server.FiberServerConfig{
 		Host: "",
@@ -15,6 +15,7 @@ require (
 	github.com/samber/slog-fiber v1.19.0
 	github.com/wagslane/go-rabbitmq v0.15.0
 	golang.org/x/crypto v0.46.0
+	golang.org/x/image v0.25.0
 	golang.org/x/oauth2 v0.34.0
 	modernc.org/sqlite v1.40.1
 )
@@ -1,36 +1,196 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cthulhu-platform/gateway/internal/microservices/authentication"
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
 	"github.com/cthulhu-platform/gateway/internal/service/file"
 	"github.com/gofiber/fiber/v2"
 )
 
 func FileUpload(s file.FileService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		form, err := c.MultipartForm()
+		// Files are streamed to storage as they arrive; fields such as password may come before or after them
+		src, err := newMultipartSource(c, "files", uploadOptionsFromForm)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success": false,
-				"error":   "invalid multipart payload",
+				"error":   err.Error(),
+			})
+		}
+		defer src.release(c)
+
+		// Extract user_id from context (optional, may be nil)
+		var userID *string
+		if uid, ok := c.Locals("user_id").(string); ok && uid != "" {
+			userID = &uid
+		}
+
+		// Anonymous uploads are charged to the client IP
+		res, err := s.UploadFiles(c.UserContext(), src, userID, c.IP())
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(uploadErrorBody(res, err))
+		}
+
+		return c.Status(fiber.StatusOK).JSON(res)
+	}
+}
+
+// uploadErrorBody describes a failed upload, including the files rejected for a digest mismatch
+func uploadErrorBody(res *filemanager.UploadResult, err error) fiber.Map {
+	body := fiber.Map{
+		"success": false,
+		"error":   err.Error(),
+	}
+	if res != nil && len(res.Rejected) > 0 {
+		body["rejected_files"] = res.Rejected
+	}
+	return body
+}
+
+// uploadOptionsFromForm reads the optional bucket settings sent alongside an upload
+func uploadOptionsFromForm(values map[string][]string) (file.UploadOptions, error) {
+	var opts file.UploadOptions
+
+	// Extract password from form data (optional)
+	if password := formValue(values, "password"); password != "" {
+		opts.Password = &password
+	}
+
+	// Extract expiry from form data (optional)
+	expiresAt, err := parseExpiry(formValue(values, "expires_in"), formValue(values, "expires_at"))
+	if err != nil {
+		return opts, err
+	}
+	opts.ExpiresAt = expiresAt
+
+	// Extract download limits from form data (optional).
+	// max_downloads is the limit of each file, not of the bucket as a whole, and files added later get it too.
+	// file_max_downloads is repeated once per file, in the same order as 'files'; empty entries use max_downloads.
+	if opts.DefaultMaxDownloads, err = parseDownloadLimit(formValue(values, "max_downloads")); err != nil {
+		return opts, errors.New("max_downloads " + err.Error())
+	}
+	for _, value := range values["file_max_downloads"] {
+		limit, err := parseDownloadLimit(value)
+		if err != nil {
+			return opts, errors.New("file_max_downloads " + err.Error())
+		}
+		opts.FileMaxDownloads = append(opts.FileMaxDownloads, limit)
+	}
+	if burn := strings.TrimSpace(formValue(values, "burn_after_reading")); burn != "" {
+		opts.BurnAfterReading, err = strconv.ParseBool(burn)
+		if err != nil {
+			return opts, errors.New("burn_after_reading must be a boolean")
+		}
+	}
+
+	// Extract title, description and labels from form data (optional).
+	// labels may be repeated or comma-separated.
+	if title := formValue(values, "title"); title != "" {
+		opts.Title = &title
+	}
+	if description := formValue(values, "description"); description != "" {
+		opts.Description = &description
+	}
+	for _, value := range values["labels"] {
+		opts.Labels = append(opts.Labels, strings.Split(value, ",")...)
+	}
+
+	return opts, nil
+}
+
+func AddFiles(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		src, err := newMultipartSource(c, "files", nil)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		defer src.release(c)
+
+		res, err := s.AddFiles(c.UserContext(), storageID, src, bucketAccess(c))
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(uploadErrorBody(res, err))
+		}
+
+		return c.Status(fiber.StatusOK).JSON(res)
+	}
+}
+
+// InitiateUpload starts a direct-to-S3 upload and returns one presigned PUT URL per declared file
+func InitiateUpload(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var body struct {
+			Files            []file.DeclaredFile `json:"files"`
+			Password         string              `json:"password"`
+			ExpiresIn        json.Number         `json:"expires_in"`
+			ExpiresAt        json.Number         `json:"expires_at"`
+			MaxDownloads     json.Number         `json:"max_downloads"`
+			BurnAfterReading bool                `json:"burn_after_reading"`
+			Title            string              `json:"title"`
+			Description      string              `json:"description"`
+			Labels           []string            `json:"labels"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
 			})
 		}
 
-		files := form.File["files"]
-		if len(files) == 0 {
+		if len(body.Files) == 0 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success": false,
 				"error":   "no files provided; expected field 'files'",
 			})
 		}
 
-		// Extract password from form data (optional)
-		var password *string
-		if passwordValues := form.Value["password"]; len(passwordValues) > 0 && passwordValues[0] != "" {
-			password = &passwordValues[0]
+		opts := file.UploadOptions{BurnAfterReading: body.BurnAfterReading, Labels: body.Labels}
+		if body.Password != "" {
+			opts.Password = &body.Password
+		}
+		if body.Title != "" {
+			opts.Title = &body.Title
+		}
+		if body.Description != "" {
+			opts.Description = &body.Description
+		}
+
+		expiresAt, err := parseExpiry(body.ExpiresIn.String(), body.ExpiresAt.String())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		opts.ExpiresAt = expiresAt
+
+		if opts.DefaultMaxDownloads, err = parseDownloadLimit(body.MaxDownloads.String()); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "max_downloads " + err.Error(),
+			})
 		}
 
 		// Extract user_id from context (optional, may be nil)
@@ -39,9 +199,53 @@ func FileUpload(s file.FileService) fiber.Handler {
 			userID = &uid
 		}
 
-		res, err := s.UploadFiles(c.UserContext(), files, userID, password)
+		res, err := s.InitiateUpload(c.UserContext(), body.Files, userID, c.IP(), opts)
 		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(res)
+	}
+}
+
+// CompleteUpload finalizes a direct-to-S3 upload once every declared object is in place
+func CompleteUpload(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		// The token may come from the X-Upload-Token header or the JSON body
+		token := strings.TrimSpace(c.Get("X-Upload-Token"))
+		if token == "" && len(c.Body()) > 0 {
+			var body struct {
+				UploadToken string `json:"upload_token"`
+			}
+			if err := c.BodyParser(&body); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   "invalid request body",
+				})
+			}
+			token = strings.TrimSpace(body.UploadToken)
+		}
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"error":   "upload token required",
+			})
+		}
+
+		res, err := s.CompleteUpload(c.UserContext(), storageID, token)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
@@ -62,31 +266,142 @@ func DownloadFile(s file.FileService) fiber.Handler {
 			})
 		}
 
-		res, err := s.DownloadFile(c.UserContext(), storageID, stringID)
+		// Set by middleware.BucketDownloadAuth when the file is opened through a share link
+		shareLinkID, _ := c.Locals("share_link_id").(string)
+
+		res, err := s.DownloadFile(c.UserContext(), storageID, stringID, file.DownloadOptions{
+			Range:   c.Get(fiber.HeaderRange),
+			IfRange: c.Get(fiber.HeaderIfRange),
+			Inline:  c.QueryBool("inline"),
+			Head:    c.Method() == fiber.MethodHead,
+
+			ShareLinkID: shareLinkID,
+		})
+		var rangeErr *file.RangeNotSatisfiableError
+		if errors.As(err, &rangeErr) {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", rangeErr.Size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			return c.Status(fileErrorStatus(err, fiber.StatusNotFound)).JSON(fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
 		}
 
+		// Redirect mode: S3 serves the bytes from a short-lived presigned URL
+		if res.RedirectURL != "" {
+			c.Set(fiber.HeaderCacheControl, "no-store")
+			return c.Redirect(res.RedirectURL, fiber.StatusFound)
+		}
+
 		contentType := res.ContentType
 		if contentType == "" {
 			contentType = "application/octet-stream"
 		}
 
 		c.Set("Content-Type", contentType)
-		if res.ContentLength > 0 {
-			c.Set("Content-Length", fmt.Sprintf("%d", res.ContentLength))
+		if res.AcceptRanges {
+			c.Set(fiber.HeaderAcceptRanges, "bytes")
+		}
+		if res.LastModified > 0 {
+			c.Set(fiber.HeaderLastModified, time.Unix(res.LastModified, 0).UTC().Format(http.TimeFormat))
+		}
+		if res.SHA256 != "" {
+			// Both describe the whole file, so they are the same on partial responses
+			c.Set(fiber.HeaderETag, file.ContentETag(res.SHA256))
+			c.Set("Digest", file.ContentDigest(res.SHA256))
+		}
+		if res.ContentRange != "" {
+			c.Set(fiber.HeaderContentRange, res.ContentRange)
+			c.Status(fiber.StatusPartialContent)
 		}
 		// Use the original filename from the download result
 		filename := res.DownloadedFile
 		if filename == "" {
 			filename = stringID
 		}
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		disposition := "attachment"
+		if res.Inline {
+			// Shown in the browser, so the file must not run anything or be reinterpreted as another type
+			disposition = "inline"
+			c.Set(fiber.HeaderContentSecurityPolicy, inlineContentSecurityPolicy)
+		}
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		c.Set("Content-Disposition", file.ContentDisposition(disposition, filename))
+
+		// HEAD: the service fetched nothing, so only the length of the file is left to send
+		if res.Body == nil {
+			c.Response().Header.SetContentLength(int(res.ContentLength))
+			return nil
+		}
+
+		// A known length is passed on so fasthttp sends Content-Length instead of chunking
+		size := -1
+		if res.ContentLength > 0 {
+			size = int(res.ContentLength)
+		}
+		if err := c.SendStream(res.Body, size); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return nil
+	}
+}
+
+// inlineContentSecurityPolicy lets an inline file render as media and nothing else
+const inlineContentSecurityPolicy = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// Thumbnail serves a JPEG preview of an image file; ?w= picks the width, rounded up to a supported size
+func Thumbnail(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := c.Params("id")
+		stringID := c.Params("filename") // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		width := file.DefaultThumbnailWidth
+		if w := c.Query("w"); w != "" {
+			parsed, err := strconv.Atoi(w)
+			if err != nil || parsed <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   "w must be a positive integer",
+				})
+			}
+			width = parsed
+		}
+
+		res, err := s.Thumbnail(c.UserContext(), storageID, stringID, width)
+		if errors.Is(err, file.ErrThumbnailBusy) {
+			c.Set(fiber.HeaderRetryAfter, "1")
+		}
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		c.Set(fiber.HeaderContentType, res.ContentType)
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		// Buckets may be password protected, so only the browser may keep a copy
+		c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+		if res.LastModified > 0 {
+			c.Set(fiber.HeaderLastModified, time.Unix(res.LastModified, 0).UTC().Format(http.TimeFormat))
+		}
 
-		if err := c.SendStream(res.Body); err != nil {
+		size := -1
+		if res.ContentLength > 0 {
+			size = int(res.ContentLength)
+		}
+		if err := c.SendStream(res.Body, size); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 		}
 		return nil
@@ -103,9 +418,12 @@ func RetrieveFileBucket(s file.FileService) fiber.Handler {
 			})
 		}
 
-		meta, err := s.RetrieveFileBucket(c.UserContext(), storageID)
+		meta, err := s.RetrieveFileBucket(c.UserContext(), storageID, file.BucketListingOptions{
+			Prefix: c.Query("prefix"),
+			Tree:   c.QueryBool("tree"),
+		})
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			return c.Status(fileErrorStatus(err, fiber.StatusNotFound)).JSON(fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
@@ -115,7 +433,7 @@ func RetrieveFileBucket(s file.FileService) fiber.Handler {
 	}
 }
 
-func GetBucketAdmins(s file.FileService) fiber.Handler {
+func DownloadBucketArchive(s file.FileService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		storageID := strings.TrimSpace(c.Params("id"))
 		if storageID == "" {
@@ -125,19 +443,60 @@ func GetBucketAdmins(s file.FileService) fiber.Handler {
 			})
 		}
 
-		admins, err := s.GetBucketAdmins(c.UserContext(), storageID)
+		archive, err := s.ArchiveBucket(c.UserContext(), storageID)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			return c.Status(fileErrorStatus(err, fiber.StatusNotFound)).JSON(fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
 		}
 
-		return c.JSON(admins)
+		c.Set("Content-Type", "application/zip")
+		c.Set("Content-Disposition", file.ContentDisposition("attachment", storageID+".zip"))
+		// Files already out of downloads; any used up while streaming are listed inside the archive
+		c.Set("X-Skipped-Files", strconv.Itoa(len(archive.Skipped)))
+
+		if c.Method() == fiber.MethodHead {
+			return nil
+		}
+
+		// The archive is built while fasthttp sends the response, after this handler has returned.
+		// fasthttp cancels nothing when the client goes away, so a failed write cancels the context instead.
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := archive.Stream(ctx, &cancelOnWriteError{w: w, cancel: cancel}); err != nil {
+				slog.Error("failed to stream bucket archive", "bucket_id", storageID, "error", err)
+			}
+			w.Flush()
+		})
+		return nil
 	}
 }
 
-func IsProtected(s file.FileService) fiber.Handler {
+// cancelOnWriteError cancels a streamed response's context once writing to the client fails
+type cancelOnWriteError struct {
+	w      *bufio.Writer
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnWriteError) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+func (c *cancelOnWriteError) Flush() error {
+	err := c.w.Flush()
+	if err != nil {
+		c.cancel()
+	}
+	return err
+}
+
+func GetBucketAdmins(s file.FileService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		storageID := strings.TrimSpace(c.Params("id"))
 		if storageID == "" {
@@ -147,7 +506,7 @@ func IsProtected(s file.FileService) fiber.Handler {
 			})
 		}
 
-		isProtected, _, err := s.IsBucketProtected(c.UserContext(), storageID)
+		admins, err := s.GetBucketAdmins(c.UserContext(), storageID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"success": false,
@@ -155,14 +514,12 @@ func IsProtected(s file.FileService) fiber.Handler {
 			})
 		}
 
-		return c.JSON(fiber.Map{
-			"protected": isProtected,
-			"bucket_id": storageID,
-		})
+		return c.JSON(admins)
 	}
 }
 
-func AuthenticateBucket(s file.FileService) fiber.Handler {
+// AddBucketAdmin makes another user an admin of the bucket, named by user_id or email in the body
+func AddBucketAdmin(s file.FileService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		storageID := strings.TrimSpace(c.Params("id"))
 		if storageID == "" {
@@ -172,9 +529,9 @@ func AuthenticateBucket(s file.FileService) fiber.Handler {
 			})
 		}
 
-		// Extract password from request body
 		var body struct {
-			Password string `json:"password"`
+			UserID string `json:"user_id"`
+			Email  string `json:"email"`
 		}
 		if err := c.BodyParser(&body); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -183,40 +540,838 @@ func AuthenticateBucket(s file.FileService) fiber.Handler {
 			})
 		}
 
-		if body.Password == "" {
+		userID, _ := c.Locals("user_id").(string)
+
+		admins, err := s.AddBucketAdmin(c.UserContext(), storageID, userID, file.NewAdmin{UserID: body.UserID, Email: body.Email})
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(admins)
+	}
+}
+
+// RemoveBucketAdmin revokes a user's admin rights on the bucket
+func RemoveBucketAdmin(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		targetID := strings.TrimSpace(c.Params("userId"))
+		if storageID == "" || targetID == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success": false,
-				"error":   "password is required",
+				"error":   "storage id and user id required",
 			})
 		}
 
-		// Extract user_id from context (if authenticated)
-		var userID *string
-		if uid, ok := c.Locals("user_id").(string); ok && uid != "" {
-			userID = &uid
+		userID, _ := c.Locals("user_id").(string)
+
+		admins, err := s.RemoveBucketAdmin(c.UserContext(), storageID, userID, targetID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
 		}
 
-		// Extract auth token JTI from claims (if available)
-		// JTI is in RegisteredClaims.ID field
-		var authTokenID *string
-		if claims, ok := c.Locals("claims").(*authentication.Claims); ok && claims != nil {
-			if claims.ID != "" {
-				authTokenID = &claims.ID
-			}
+		return c.JSON(admins)
+	}
+}
+
+// TransferBucketOwnership hands the bucket to another of its admins, named by user_id in the body
+func TransferBucketOwnership(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
 		}
 
-		// Authenticate and get token
-		token, err := s.AuthenticateBucket(c.UserContext(), storageID, body.Password, userID, authTokenID)
+		var body struct {
+			UserID string `json:"user_id"`
+		}
+		if err := c.BodyParser(&body); err != nil || strings.TrimSpace(body.UserID) == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "user_id of the new owner required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		admins, err := s.TransferBucketOwnership(c.UserContext(), storageID, userID, strings.TrimSpace(body.UserID))
 		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
 		}
 
-		return c.JSON(fiber.Map{
-			"access_token": token,
-			"expires_in":   1800, // 30 minutes in seconds
-		})
+		return c.JSON(admins)
+	}
+}
+
+func IsProtected(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		isProtected, _, err := s.IsBucketProtected(c.UserContext(), storageID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusNotFound)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"protected": isProtected,
+			"bucket_id": storageID,
+		})
+	}
+}
+
+func AuthenticateBucket(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		// Extract password from request body
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
+			})
+		}
+
+		if body.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "password is required",
+			})
+		}
+
+		// Extract user_id from context (if authenticated)
+		var userID *string
+		if uid, ok := c.Locals("user_id").(string); ok && uid != "" {
+			userID = &uid
+		}
+
+		// Extract auth token JTI from claims (if available)
+		// JTI is in RegisteredClaims.ID field
+		var authTokenID *string
+		if claims, ok := c.Locals("claims").(*authentication.Claims); ok && claims != nil {
+			if claims.ID != "" {
+				authTokenID = &claims.ID
+			}
+		}
+
+		// Authenticate and get token
+		token, err := s.AuthenticateBucket(c.UserContext(), storageID, body.Password, c.IP(), userID, authTokenID)
+		var attemptsErr *file.TooManyAttemptsError
+		if errors.As(err, &attemptsErr) {
+			c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(int64(math.Ceil(attemptsErr.RetryAfter.Seconds())), 1), 10))
+		}
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusUnauthorized)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"access_token": token,
+			"expires_in":   1800, // 30 minutes in seconds
+		})
+	}
+}
+
+// CreateShareLink makes a link that downloads one file without the bucket password.
+// The body may set expires_in or expires_at, max_downloads and label.
+func CreateShareLink(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		var body struct {
+			ExpiresIn    json.Number `json:"expires_in"`
+			ExpiresAt    json.Number `json:"expires_at"`
+			MaxDownloads json.Number `json:"max_downloads"`
+			Label        string      `json:"label"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   "invalid request body",
+				})
+			}
+		}
+
+		opts := file.ShareLinkOptions{Label: body.Label}
+		expiresAt, err := parseExpiry(body.ExpiresIn.String(), body.ExpiresAt.String())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		opts.ExpiresAt = expiresAt
+
+		if opts.MaxDownloads, err = parseDownloadLimit(body.MaxDownloads.String()); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "max_downloads " + err.Error(),
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		link, err := s.CreateShareLink(c.UserContext(), storageID, stringID, userID, opts)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(link)
+	}
+}
+
+// ListShareLinks lists the share links of one file
+func ListShareLinks(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		links, err := s.ListShareLinks(c.UserContext(), storageID, stringID, userID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"bucket_id": storageID,
+			"file_id":   stringID,
+			"links":     links,
+		})
+	}
+}
+
+// RevokeShareLink deletes a share link so it stops working
+func RevokeShareLink(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		linkID := strings.TrimSpace(c.Params("linkId"))
+		if storageID == "" || stringID == "" || linkID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id, string id and link id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		if err := s.RevokeShareLink(c.UserContext(), storageID, stringID, linkID, userID); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"link_id":   linkID,
+		})
+	}
+}
+
+// MintBucketAccessToken issues a bucket access token limited to the privileges in the body
+func MintBucketAccessToken(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		var body struct {
+			Privileges []string `json:"privileges"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		token, err := s.MintBucketAccessToken(c.UserContext(), storageID, userID, body.Privileges)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(token)
+	}
+}
+
+// ListBucketTokens lists the bucket's access tokens that are still valid
+func ListBucketTokens(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		tokens, err := s.ListBucketTokens(c.UserContext(), storageID, userID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"bucket_id": storageID,
+			"tokens":    tokens,
+		})
+	}
+}
+
+// RevokeBucketToken revokes one access token of the bucket by its jti
+func RevokeBucketToken(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		tokenID := strings.TrimSpace(c.Params("tokenId"))
+		if storageID == "" || tokenID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and token id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		if err := s.RevokeBucketToken(c.UserContext(), storageID, tokenID, userID); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"revoked":   1,
+		})
+	}
+}
+
+// RevokeBucketTokens revokes every access token of the bucket
+func RevokeBucketTokens(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		revoked, err := s.RevokeBucketTokens(c.UserContext(), storageID, userID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"revoked":   revoked,
+		})
+	}
+}
+
+// UpdateBucketDetails changes the title, description and labels of a bucket.
+// Fields left out of the body are kept; an empty string or list clears one.
+func UpdateBucketDetails(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		var body struct {
+			Title       *string   `json:"title"`
+			Description *string   `json:"description"`
+			Labels      *[]string `json:"labels"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
+			})
+		}
+		if body.Title == nil && body.Description == nil && body.Labels == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "nothing to update; expected title, description or labels",
+			})
+		}
+
+		meta, err := s.UpdateBucketDetails(c.UserContext(), storageID, bucketAccess(c), file.BucketDetailsUpdate{
+			Title:       body.Title,
+			Description: body.Description,
+			Labels:      body.Labels,
+		})
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(meta)
+	}
+}
+
+// ListBucketLockouts shows the recent lockouts caused by failed password attempts on the bucket
+func ListBucketLockouts(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		lockouts, err := s.ListBucketLockouts(c.UserContext(), storageID, userID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"bucket_id": storageID,
+			"lockouts":  lockouts,
+		})
+	}
+}
+
+// SetBucketPassword changes the bucket's password to the one in the body
+func SetBucketPassword(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
+			})
+		}
+		if body.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "password is required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		if err := s.SetBucketPassword(c.UserContext(), storageID, userID, &body.Password); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"protected": true,
+		})
+	}
+}
+
+// RemoveBucketPassword makes a protected bucket public again
+func RemoveBucketPassword(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		if err := s.SetBucketPassword(c.UserContext(), storageID, userID, nil); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"protected": false,
+		})
+	}
+}
+
+func DeleteBucket(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		if storageID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id required",
+			})
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		if err := s.DeleteBucket(c.UserContext(), storageID, userID); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+		})
+	}
+}
+
+func DeleteFile(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		if err := s.DeleteFile(c.UserContext(), storageID, stringID, bucketAccess(c)); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"bucket_id": storageID,
+			"string_id": stringID,
+		})
+	}
+}
+
+func ReplaceFile(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		src, err := newMultipartSource(c, "file", nil)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		defer src.release(c)
+
+		info, err := s.ReplaceFile(c.UserContext(), storageID, stringID, bucketAccess(c), src)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(info)
+	}
+}
+
+// MoveFile renames a file or moves it to another folder of its bucket.
+// Only the fields present in the body change; its string_id and links stay the same.
+func MoveFile(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID := strings.TrimSpace(c.Params("id"))
+		stringID := strings.TrimSpace(c.Params("filename")) // URL param is actually string_id, not filename
+		if storageID == "" || stringID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "storage id and string id required",
+			})
+		}
+
+		var body struct {
+			Name *string `json:"name"`
+			Path *string `json:"path"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "invalid request body",
+			})
+		}
+		if body.Name == nil && body.Path == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "nothing to update; expected name or path",
+			})
+		}
+
+		info, err := s.MoveFile(c.UserContext(), storageID, stringID, bucketAccess(c), file.FileMove{
+			Name: body.Name,
+			Path: body.Path,
+		})
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(info)
+	}
+}
+
+// GetUsage reports the storage the logged-in user consumes and their quota
+func GetUsage(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, _ := c.Locals("user_id").(string)
+
+		report, err := s.GetUsage(c.UserContext(), userID)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(report)
+	}
+}
+
+// ListBuckets lists the logged-in user's buckets.
+// Query parameters: sort (created_at, expires_at, size or files), order (asc or desc), limit and offset.
+func ListBuckets(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, _ := c.Locals("user_id").(string)
+
+		opts := file.ListBucketsOptions{
+			Sort:  strings.ToLower(strings.TrimSpace(c.Query("sort"))),
+			Order: strings.ToLower(strings.TrimSpace(c.Query("order"))),
+		}
+		for name, target := range map[string]*int{"limit": &opts.Limit, "offset": &opts.Offset} {
+			value := strings.TrimSpace(c.Query(name))
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   name + " must be an integer",
+				})
+			}
+			*target = n
+		}
+
+		list, err := s.ListBuckets(c.UserContext(), userID, opts)
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(list)
+	}
+}
+
+// fileErrorStatus maps file service errors to HTTP status codes, using fallback for anything unrecognized
+// bucketAccess collects who acts on the bucket: the logged-in user and the bucket access token
+// the bucket middleware validated, either of which may be missing
+func bucketAccess(c *fiber.Ctx) file.BucketAccess {
+	userID, _ := c.Locals("user_id").(string)
+	claims, _ := c.Locals("bucket_claims").(*file.BucketAccessClaims)
+	return file.BucketAccess{UserID: userID, Claims: claims}
+}
+
+func fileErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, file.ErrBucketNotFound), errors.Is(err, file.ErrFileNotFound),
+		errors.Is(err, file.ErrUploadSessionNotFound), errors.Is(err, file.ErrTusUploadNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, file.ErrUserNotFound), errors.Is(err, file.ErrAdminNotFound),
+		errors.Is(err, file.ErrShareLinkNotFound), errors.Is(err, file.ErrBucketTokenNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, file.ErrInvalidShareLink):
+		return fiber.StatusUnauthorized
+	case errors.Is(err, file.ErrNotBucketAdmin), errors.Is(err, file.ErrInvalidUploadToken),
+		errors.Is(err, file.ErrNotBucketOwner), errors.Is(err, file.ErrCannotRemoveOwner):
+		return fiber.StatusForbidden
+	case errors.Is(err, file.ErrAlreadyBucketAdmin):
+		return fiber.StatusConflict
+	case errors.Is(err, file.ErrUploadIncomplete), errors.Is(err, file.ErrTusOffsetMismatch):
+		return fiber.StatusConflict
+	case errors.Is(err, file.ErrBucketExpired), errors.Is(err, file.ErrDownloadLimitReached),
+		errors.Is(err, file.ErrUploadSessionExpired), errors.Is(err, file.ErrShareLinkExpired):
+		return fiber.StatusGone
+	case errors.Is(err, file.ErrTusUploadLocked):
+		return fiber.StatusLocked
+	case errors.Is(err, file.ErrTooManyAttempts):
+		return fiber.StatusTooManyRequests
+	case errors.Is(err, file.ErrTusChunkTooLarge), errors.Is(err, file.ErrFileTooLarge),
+		errors.Is(err, file.ErrStorageQuotaExceeded):
+		return fiber.StatusRequestEntityTooLarge
+	case errors.Is(err, file.ErrBucketQuotaExceeded):
+		return fiber.StatusForbidden
+	case errors.Is(err, file.ErrTusChecksumMismatch):
+		return 460 // Checksum Mismatch, defined by the tus checksum extension
+	case errors.Is(err, file.ErrTusUnsupportedChecksum):
+		return fiber.StatusBadRequest
+	case errors.Is(err, file.ErrContentDigestMismatch):
+		return fiber.StatusUnprocessableEntity
+	case errors.Is(err, file.ErrThumbnailUnsupported):
+		return fiber.StatusUnsupportedMediaType
+	case errors.Is(err, file.ErrThumbnailUnavailable):
+		return fiber.StatusForbidden
+	case errors.Is(err, file.ErrThumbnailBusy), errors.Is(err, file.ErrTusStagingFull):
+		return fiber.StatusServiceUnavailable
+	default:
+		return fallback
+	}
+}
+
+// parseExpiry turns the optional expires_in (seconds from now) or expires_at (Unix timestamp)
+// upload fields into an absolute expiry; at most one of them may be set
+func parseExpiry(expiresIn, expiresAt string) (*int64, error) {
+	expiresIn = strings.TrimSpace(expiresIn)
+	expiresAt = strings.TrimSpace(expiresAt)
+
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return nil, errors.New("only one of expires_in or expires_at may be set")
+	case expiresIn != "":
+		seconds, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("expires_in must be a positive number of seconds")
+		}
+		ts := time.Now().Unix() + seconds
+		return &ts, nil
+	case expiresAt != "":
+		ts, err := strconv.ParseInt(expiresAt, 10, 64)
+		if err != nil || ts <= 0 {
+			return nil, errors.New("expires_at must be a Unix timestamp")
+		}
+		return &ts, nil
+	default:
+		return nil, nil
+	}
+}
+
+// parseDownloadLimit parses an optional positive download limit; "" means unlimited
+func parseDownloadLimit(value string) (*int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return nil, errors.New("must be a positive integer")
+	}
+	return &limit, nil
+}
+
+// formValue returns the first value of a multipart form field, or "" if it is missing
+func formValue(values map[string][]string, key string) string {
+	if v := values[key]; len(v) > 0 {
+		return v[0]
 	}
+	return ""
 }
@@ -0,0 +1,824 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices"
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/middleware"
+	"github.com/cthulhu-platform/gateway/internal/pkg"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"github.com/cthulhu-platform/gateway/internal/service/file"
+	"github.com/gofiber/fiber/v2"
+)
+
+// memFilemanager keeps objects in memory in place of S3
+type memFilemanager struct {
+	filemanager.FilemanagerConnection
+	mu        sync.Mutex
+	objects   map[string][]byte
+	downloads int // Whole-object downloads, which finalizing a presigned upload must not need
+}
+
+func (m *memFilemanager) UploadStream(ctx context.Context, storageID, filename, contentType string, body io.Reader) (int64, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[storageID+"/"+filename] = b
+	return int64(len(b)), nil
+}
+
+func (m *memFilemanager) Download(ctx context.Context, storageID, filename string) (*filemanager.DownloadResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloads++
+	b, ok := m.objects[storageID+"/"+filename]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return &filemanager.DownloadResult{
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		AcceptRanges:  true,
+	}, nil
+}
+
+func (m *memFilemanager) DownloadRange(ctx context.Context, storageID, filename string, start, end int64) (*filemanager.DownloadResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[storageID+"/"+filename]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return &filemanager.DownloadResult{
+		Body:          io.NopCloser(bytes.NewReader(b[start : end+1])),
+		ContentLength: end - start + 1,
+		ContentRange:  fmt.Sprintf("bytes %d-%d/%d", start, end, len(b)),
+		AcceptRanges:  true,
+	}, nil
+}
+
+func (m *memFilemanager) Delete(ctx context.Context, storageID, filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, storageID+"/"+filename)
+	return nil
+}
+
+func (m *memFilemanager) DeleteStorage(ctx context.Context, storageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.objects {
+		if strings.HasPrefix(key, storageID+"/") {
+			delete(m.objects, key)
+		}
+	}
+	return nil
+}
+
+func (m *memFilemanager) PresignUpload(ctx context.Context, storageID, filename string, opts filemanager.PresignUploadOptions) (string, error) {
+	return "https://s3.test/" + storageID + "/" + filename, nil
+}
+
+// Head reports the checksum S3 records for a PUT carrying the signed x-amz-checksum-sha256
+func (m *memFilemanager) Head(ctx context.Context, storageID, filename string) (*filemanager.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[storageID+"/"+filename]
+	if !ok {
+		return nil, nil
+	}
+	sum := sha256.Sum256(b)
+	return &filemanager.ObjectInfo{Size: int64(len(b)), ChecksumSHA256: base64.StdEncoding.EncodeToString(sum[:])}, nil
+}
+
+func (m *memFilemanager) Copy(ctx context.Context, srcStorageID, srcFilename, storageID, filename, contentType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[srcStorageID+"/"+srcFilename]
+	if !ok {
+		return errors.New("no such object")
+	}
+	m.objects[storageID+"/"+filename] = b
+	return nil
+}
+
+func (m *memFilemanager) put(key string, b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = b
+}
+
+func (m *memFilemanager) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.objects)
+}
+
+// partsSource uploads files from memory
+type partsSource struct {
+	parts []*file.UploadPart
+	opts  file.UploadOptions
+}
+
+func (s *partsSource) NextFile() (*file.UploadPart, error) {
+	if len(s.parts) == 0 {
+		return nil, io.EOF
+	}
+	part := s.parts[0]
+	s.parts = s.parts[1:]
+	return part, nil
+}
+
+func (s *partsSource) Options() (file.UploadOptions, error) { return s.opts, nil }
+
+func newTestFileService(t *testing.T) (file.FileService, local.FileRepository, *memFilemanager) {
+	t.Helper()
+	pkg.LOCAL_FILE_REPO = filepath.Join(t.TempDir(), "file.db")
+	repo, err := local.NewLocalFileRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	fm := &memFilemanager{objects: make(map[string][]byte)}
+	return file.NewLocalFileService(&microservices.ServiceConnectionContainer{Filemanager: fm}, repo), repo, fm
+}
+
+func TestDownloadFileHeadConsumesNothing(t *testing.T) {
+	s, repo, fm := newTestFileService(t)
+
+	one := int64(1)
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{{Name: "secret.txt", Body: strings.NewReader("hello")}},
+		opts:  file.UploadOptions{DefaultMaxDownloads: &one, BurnAfterReading: true},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/files/s/" + res.StorageID + "/d/" + res.Files[0].StringID
+
+	app := fiber.New()
+	app.Get("/files/s/:id/d/:filename", DownloadFile(s))
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodHead, url, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || resp.ContentLength != 5 {
+		t.Fatalf("HEAD: status %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	// Give a burn started by the HEAD time to run, so the check below would catch it
+	time.Sleep(50 * time.Millisecond)
+	dbFile, err := repo.GetFileByStringID(res.Files[0].StringID)
+	if err != nil || dbFile == nil {
+		t.Fatalf("file gone after HEAD: %v", err)
+	}
+	if dbFile.DownloadCount != 0 {
+		t.Fatalf("HEAD counted a download: download_count = %d", dbFile.DownloadCount)
+	}
+	if fm.count() != 1 {
+		t.Fatalf("HEAD removed the object")
+	}
+
+	// The one real download is served in full and then burns the file
+	resp, err = app.Test(httptest.NewRequest(fiber.MethodGet, url, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(body) != "hello" {
+		t.Fatalf("GET: status %d, body %q", resp.StatusCode, body)
+	}
+	for deadline := time.Now().Add(2 * time.Second); fm.count() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("file was not burnt after its last download")
+		}
+	}
+}
+
+func TestDownloadBucketArchiveCountsWrittenEntries(t *testing.T) {
+	s, repo, _ := newTestFileService(t)
+
+	one := int64(1)
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{
+			{Name: "a.txt", Body: strings.NewReader("first")},
+			{Name: "b.txt", Body: strings.NewReader("second")},
+		},
+		opts: file.UploadOptions{FileMaxDownloads: []*int64{&one, nil}},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An archive the client abandons counts nothing
+	archive, err := s.ArchiveBucket(context.Background(), res.StorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Stream(context.Background(), failingWriter{}); err == nil {
+		t.Fatal("stream to a failed client succeeded")
+	}
+	for _, f := range res.Files {
+		dbFile, _ := repo.GetFileByStringID(f.StringID)
+		if dbFile.DownloadCount != 0 {
+			t.Fatalf("%s counted by an aborted archive", f.OriginalName)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/files/s/:id/archive.zip", DownloadBucketArchive(s))
+	get := func() (*zip.Reader, string) {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/files/s/"+res.StorageID+"/archive.zip", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr, resp.Header.Get("X-Skipped-Files")
+	}
+
+	zr, skipped := get()
+	if len(zr.File) != 2 || skipped != "0" {
+		t.Fatalf("first archive: %d entries, %s skipped", len(zr.File), skipped)
+	}
+
+	// a.txt has used its one download, so the second archive says it left it out
+	zr, skipped = get()
+	if skipped != "1" || len(zr.File) != 2 || zr.File[0].Name != "b.txt" || zr.File[1].Name != "SKIPPED_FILES.txt" {
+		t.Fatalf("second archive: %s skipped, entries %v", skipped, zr.File)
+	}
+	rc, _ := zr.File[1].Open()
+	listing, _ := io.ReadAll(rc)
+	if !strings.Contains(string(listing), "a.txt") {
+		t.Fatalf("skipped files listing: %q", listing)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("client went away") }
+
+func TestOpenUploadsCountTowardsQuota(t *testing.T) {
+	storage, folder := pkg.QUOTA_ANONYMOUS_STORAGE_MB, pkg.FILE_FOLDER
+	t.Cleanup(func() { pkg.QUOTA_ANONYMOUS_STORAGE_MB, pkg.FILE_FOLDER = storage, folder })
+	pkg.QUOTA_ANONYMOUS_STORAGE_MB, pkg.FILE_FOLDER = "1", t.TempDir()
+	s, _, _ := newTestFileService(t)
+
+	app := fiber.New()
+	app.Post("/files/uploads", InitiateUpload(s))
+	app.Post("/files/tus", TusCreate(s))
+	initiate := func() int {
+		req := httptest.NewRequest(fiber.MethodPost, "/files/uploads",
+			strings.NewReader(`{"files":[{"name":"half.bin","size":600000,"sha256":"`+strings.Repeat("0", 64)+`"}]}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	// Each session fits the 1 MiB quota alone, but not next to the first one still open
+	if status := initiate(); status != fiber.StatusOK && status != fiber.StatusCreated {
+		t.Fatalf("first session: status %d", status)
+	}
+	if status := initiate(); status != fiber.StatusRequestEntityTooLarge {
+		t.Fatalf("second presigned session: status %d, want 413", status)
+	}
+
+	req := httptest.NewRequest(fiber.MethodPost, "/files/tus", nil)
+	req.Header.Set("Upload-Length", "600000")
+	req.Header.Set("Upload-Metadata", "filename aGFsZi5iaW4=") // half.bin
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusRequestEntityTooLarge {
+		t.Fatalf("tus upload next to the open session: status %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestCompleteUploadCopiesWithinStorage(t *testing.T) {
+	s, repo, fm := newTestFileService(t)
+
+	content := []byte("%PDF-1.4 presigned")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	app := fiber.New()
+	app.Post("/files/uploads", InitiateUpload(s))
+	app.Post("/files/uploads/:id/complete", CompleteUpload(s))
+	post := func(url, body, token string) *http.Response {
+		req := httptest.NewRequest(fiber.MethodPost, url, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set("X-Upload-Token", token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A file without its digest cannot be presigned
+	if resp := post("/files/uploads", `{"files":[{"name":"doc.pdf","size":18}]}`, ""); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("upload without sha256: status %d, want 400", resp.StatusCode)
+	}
+
+	resp := post("/files/uploads", fmt.Sprintf(`{"files":[{"name":"doc.pdf","size":%d,"sha256":%q}]}`, len(content), digest), "")
+	var session file.PresignedUpload
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	upload := session.Files[0]
+	if want := base64.StdEncoding.EncodeToString(sum[:]); upload.Headers["x-amz-checksum-sha256"] != want {
+		t.Fatalf("presigned PUT headers %v do not carry the checksum", upload.Headers)
+	}
+
+	complete := "/files/uploads/" + session.StorageID + "/complete"
+	if resp := post(complete, "", session.UploadToken); resp.StatusCode != fiber.StatusConflict {
+		t.Fatalf("complete before the PUT: status %d, want 409", resp.StatusCode)
+	}
+	fm.put(session.StorageID+"/"+upload.StringID, content)
+	if resp := post(complete, "", session.UploadToken); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("complete: status %d", resp.StatusCode)
+	}
+
+	dbFile, err := repo.GetFileByStringID(upload.StringID)
+	if err != nil || dbFile == nil {
+		t.Fatalf("file not recorded: %v", err)
+	}
+	if dbFile.SHA256 == nil || *dbFile.SHA256 != digest || dbFile.ContentType != "application/pdf" {
+		t.Fatalf("recorded sha256 %v, content type %q", dbFile.SHA256, dbFile.ContentType)
+	}
+	if fm.downloads != 0 {
+		t.Fatalf("finalizing downloaded the whole object %d times", fm.downloads)
+	}
+	if fm.count() != 1 || !bytes.Equal(fm.objects[dbFile.S3Key], content) {
+		t.Fatalf("objects after completion: %d, blob holds %q", fm.count(), fm.objects[dbFile.S3Key])
+	}
+}
+
+func TestShareLinkCountsOnlyFullDownloads(t *testing.T) {
+	secret := pkg.JWT_SECRET
+	t.Cleanup(func() { pkg.JWT_SECRET = secret })
+	pkg.JWT_SECRET = "test-secret"
+	s, repo, _ := newTestFileService(t)
+
+	password := "hunter2"
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{
+			{Name: "shared.txt", Body: strings.NewReader("hello")},
+			{Name: "other.txt", Body: strings.NewReader("world")},
+		},
+		opts: file.UploadOptions{Password: &password},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, other := res.Files[0].StringID, res.Files[1].StringID
+	if err := repo.AddBucketAdmin(&local.BucketAdmin{UserID: "admin", BucketID: res.StorageID, CreatedAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := s.CreateShareLink(context.Background(), res.StorageID, shared, "admin", file.ShareLinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.URL[strings.Index(link.URL, "?link=")+len("?link="):]
+
+	app := fiber.New()
+	app.Get("/files/s/:id/d/:filename", middleware.BucketDownloadAuth(s, nil), DownloadFile(s))
+	app.Get("/files/s/:id/t/:filename", middleware.BucketPasswordAuth(s, nil, file.PrivilegeRead), Thumbnail(s))
+	request := func(method, path, rangeHeader string) int {
+		req := httptest.NewRequest(method, path+"?link="+token, nil)
+		if rangeHeader != "" {
+			req.Header.Set(fiber.HeaderRange, rangeHeader)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	downloads := func() int64 {
+		l, err := repo.GetShareLinkByID(link.ID)
+		if err != nil || l == nil {
+			t.Fatalf("share link: %v", err)
+		}
+		return l.DownloadCount
+	}
+
+	if status := request(fiber.MethodHead, "/files/s/"+res.StorageID+"/d/"+shared, ""); status != fiber.StatusOK {
+		t.Fatalf("HEAD: status %d", status)
+	}
+	if status := request(fiber.MethodGet, "/files/s/"+res.StorageID+"/d/"+shared, "bytes=0-1"); status != fiber.StatusPartialContent {
+		t.Fatalf("range: status %d", status)
+	}
+	if n := downloads(); n != 0 {
+		t.Fatalf("HEAD and range requests counted %d link downloads", n)
+	}
+	if status := request(fiber.MethodGet, "/files/s/"+res.StorageID+"/d/"+shared, ""); status != fiber.StatusOK {
+		t.Fatalf("GET: status %d", status)
+	}
+	if n := downloads(); n != 1 {
+		t.Fatalf("full download counted %d link downloads, want 1", n)
+	}
+
+	// The link opens neither another file of the bucket nor the thumbnail route
+	if status := request(fiber.MethodGet, "/files/s/"+res.StorageID+"/d/"+other, ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("link used for another file: status %d", status)
+	}
+	if status := request(fiber.MethodGet, "/files/s/"+res.StorageID+"/t/"+shared, ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("link used for a thumbnail: status %d", status)
+	}
+}
+
+func TestMintedTokenPrivileges(t *testing.T) {
+	secret := pkg.JWT_SECRET
+	t.Cleanup(func() { pkg.JWT_SECRET = secret })
+	pkg.JWT_SECRET = "test-secret"
+	s, repo, _ := newTestFileService(t)
+
+	password := "hunter2"
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{{Name: "report.txt", Body: strings.NewReader("hello")}},
+		opts:  file.UploadOptions{Password: &password},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddBucketAdmin(&local.BucketAdmin{UserID: "admin", BucketID: res.StorageID, CreatedAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	mint := func(privileges ...string) string {
+		token, err := s.MintBucketAccessToken(context.Background(), res.StorageID, "admin", privileges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.AccessToken
+	}
+	if _, err := s.MintBucketAccessToken(context.Background(), res.StorageID, "admin", []string{file.PrivilegeAdmin}); err == nil {
+		t.Fatal("minted a token granting admin")
+	}
+
+	app := fiber.New()
+	app.Get("/files/s/:id/d/:filename", middleware.BucketDownloadAuth(s, nil), DownloadFile(s))
+	app.Delete("/files/s/:id/d/:filename", middleware.OptionalJWTAuth(nil), middleware.BucketPasswordAuth(s, nil, file.PrivilegeDelete), DeleteFile(s))
+	url := "/files/s/" + res.StorageID + "/d/" + res.Files[0].StringID
+	request := func(method, token string) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("X-Bucket-Access", token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	read := mint(file.PrivilegeRead)
+	if status := request(fiber.MethodDelete, read); status != fiber.StatusForbidden {
+		t.Fatalf("delete with a read token: status %d, want 403", status)
+	}
+	if status := request(fiber.MethodGet, read); status != fiber.StatusOK {
+		t.Fatalf("download with a read token: status %d, want 200", status)
+	}
+
+	// A token granting delete stands in for a logged-in bucket admin
+	if status := request(fiber.MethodDelete, mint(file.PrivilegeDelete)); status != fiber.StatusOK {
+		t.Fatalf("delete with a delete token: status %d, want 200", status)
+	}
+	if f, err := repo.GetFileByStringID(res.Files[0].StringID); err != nil || f != nil {
+		t.Fatalf("file still there after delete: %v", err)
+	}
+}
+
+func TestTusUploadFinishesInBackground(t *testing.T) {
+	staging, folder := pkg.TUS_STAGING_MAX_MB, pkg.FILE_FOLDER
+	t.Cleanup(func() { pkg.TUS_STAGING_MAX_MB, pkg.FILE_FOLDER = staging, folder })
+	pkg.TUS_STAGING_MAX_MB, pkg.FILE_FOLDER = "1", t.TempDir()
+	s, _, fm := newTestFileService(t)
+	stagingDir := filepath.Join(pkg.FILE_FOLDER, "tus")
+
+	app := fiber.New()
+	app.Post("/files/tus", TusCreate(s))
+	app.Head("/files/tus/:uploadId", TusHead(s))
+	app.Patch("/files/tus/:uploadId", TusPatch(s))
+	app.Delete("/files/tus/:uploadId", TusDelete(s))
+	send := func(req *http.Request) *http.Response {
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	create := func() *http.Response {
+		req := httptest.NewRequest(fiber.MethodPost, "/files/tus", nil)
+		req.Header.Set("Upload-Length", "600000")
+		req.Header.Set("Upload-Metadata", "filename aGFsZi5iaW4=") // half.bin
+		return send(req)
+	}
+
+	resp := create()
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	location := resp.Header.Get(fiber.HeaderLocation)
+
+	// Staging another 600000 bytes next to the open upload would outgrow the 1 MiB staging space
+	if resp := create(); resp.StatusCode != fiber.StatusServiceUnavailable || resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Fatalf("create past the staging space: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get(fiber.HeaderRetryAfter))
+	}
+
+	req := httptest.NewRequest(fiber.MethodPatch, location, bytes.NewReader(make([]byte, 600000)))
+	req.Header.Set(fiber.HeaderContentType, tusContentType)
+	req.Header.Set("Upload-Offset", "0")
+	if resp := send(req); resp.StatusCode != fiber.StatusNoContent || resp.Header.Get("Upload-Offset") != "600000" {
+		t.Fatalf("last PATCH: status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	// HEAD reports the file once it has been stored
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp := send(httptest.NewRequest(fiber.MethodHead, location, nil)); resp.Header.Get("X-File-Id") != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upload was not stored as a file")
+		}
+	}
+
+	// Terminating waits out the finish, which holds the upload until its staged bytes are removed,
+	// and leaves the stored file in its bucket
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp := send(httptest.NewRequest(fiber.MethodDelete, location, nil))
+		if resp.StatusCode == fiber.StatusNoContent {
+			break
+		}
+		if resp.StatusCode != fiber.StatusLocked || time.Now().After(deadline) {
+			t.Fatalf("terminate after finishing: status %d", resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, path.Base(location))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("staged bytes left behind: %v", err)
+	}
+	if fm.count() != 1 {
+		t.Fatalf("%d objects stored, want 1", fm.count())
+	}
+	if resp := create(); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("create once the first upload is stored: status %d", resp.StatusCode)
+	}
+}
+
+func TestTusPatchRejectsBadChunks(t *testing.T) {
+	folder := pkg.FILE_FOLDER
+	t.Cleanup(func() { pkg.FILE_FOLDER = folder })
+	pkg.FILE_FOLDER = t.TempDir()
+	s, _, _ := newTestFileService(t)
+
+	app := fiber.New()
+	app.Post("/files/tus", TusCreate(s))
+	app.Head("/files/tus/:uploadId", TusHead(s))
+	app.Patch("/files/tus/:uploadId", TusPatch(s))
+	app.Delete("/files/tus/:uploadId", TusDelete(s))
+	send := func(req *http.Request) *http.Response {
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	patch := func(location string, offset int, chunk, checksum string) *http.Response {
+		req := httptest.NewRequest(fiber.MethodPatch, location, strings.NewReader(chunk))
+		req.Header.Set(fiber.HeaderContentType, tusContentType)
+		req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+		if checksum != "" {
+			req.Header.Set("Upload-Checksum", checksum)
+		}
+		return send(req)
+	}
+	offset := func(location string) string {
+		return send(httptest.NewRequest(fiber.MethodHead, location, nil)).Header.Get("Upload-Offset")
+	}
+
+	req := httptest.NewRequest(fiber.MethodPost, "/files/tus", nil)
+	req.Header.Set("Upload-Length", "10")
+	req.Header.Set("Upload-Metadata", "filename aGVsbG8udHh0") // hello.txt
+	location := send(req).Header.Get(fiber.HeaderLocation)
+
+	if resp := patch(location, 0, "hello", ""); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("first chunk: status %d", resp.StatusCode)
+	}
+
+	// A chunk sent for an offset the server is not at is refused without touching the upload
+	if resp := patch(location, 3, "world", ""); resp.StatusCode != fiber.StatusConflict {
+		t.Fatalf("offset mismatch: status %d, want 409", resp.StatusCode)
+	}
+
+	// A chunk whose digest does not match is dropped as a whole
+	wrong := sha1.Sum([]byte("other"))
+	if resp := patch(location, 5, "world", "sha1 "+base64.StdEncoding.EncodeToString(wrong[:])); resp.StatusCode != 460 {
+		t.Fatalf("checksum mismatch: status %d, want 460", resp.StatusCode)
+	}
+	if got := offset(location); got != "5" {
+		t.Fatalf("offset after rejected chunks: %s, want 5", got)
+	}
+
+	// Terminating the upload discards it
+	if resp := send(httptest.NewRequest(fiber.MethodDelete, location, nil)); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("terminate: status %d", resp.StatusCode)
+	}
+	if resp := send(httptest.NewRequest(fiber.MethodHead, location, nil)); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("HEAD after terminate: status %d, want 404", resp.StatusCode)
+	}
+	if resp := patch(location, 5, "world", ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("PATCH after terminate: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAuthenticateBucketLocksOutGuessers(t *testing.T) {
+	secret := pkg.JWT_SECRET
+	t.Cleanup(func() { pkg.JWT_SECRET = secret })
+	pkg.JWT_SECRET = "test-secret"
+	s, _, _ := newTestFileService(t)
+
+	password := "hunter2"
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{{Name: "secret.txt", Body: strings.NewReader("hello")}},
+		opts:  file.UploadOptions{Password: &password},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{ProxyHeader: fiber.HeaderXForwardedFor})
+	app.Post("/files/s/:id/authenticate", AuthenticateBucket(s))
+	authenticate := func(clientIP, password string) *http.Response {
+		req := httptest.NewRequest(fiber.MethodPost, "/files/s/"+res.StorageID+"/authenticate",
+			strings.NewReader(fmt.Sprintf(`{"password":%q}`, password)))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(fiber.HeaderXForwardedFor, clientIP)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for i := 1; i <= 5; i++ {
+		if resp := authenticate("198.51.100.7", "wrong"); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status %d, want 401", i, resp.StatusCode)
+		}
+	}
+
+	// The guessing IP is locked out, even with the right password, and told when to come back
+	resp := authenticate("198.51.100.7", password)
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("locked out IP: status %d, want 429", resp.StatusCode)
+	}
+	if retryAfter, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter)); err != nil || retryAfter < 1 || retryAfter > 30 {
+		t.Fatalf("Retry-After %q, want 1 to 30 seconds", resp.Header.Get(fiber.HeaderRetryAfter))
+	}
+
+	// Other clients of the bucket are not locked out by one guesser
+	if resp := authenticate("203.0.113.9", password); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("another IP: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUpdateBucketDetailsChangesOnlyWhatIsSent(t *testing.T) {
+	s, repo, _ := newTestFileService(t)
+
+	password, title, description := "hunter2", "Holiday", "Photos from *June*"
+	res, err := s.UploadFiles(context.Background(), &partsSource{
+		parts: []*file.UploadPart{{Name: "beach.txt", Body: strings.NewReader("sand")}},
+		opts: file.UploadOptions{
+			Password: &password, Title: &title, Description: &description, Labels: []string{"photos", "2026"},
+		},
+	}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddBucketAdmin(&local.BucketAdmin{UserID: "admin", BucketID: res.StorageID, CreatedAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := repo.GetBucketByID(res.StorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Patch("/files/s/:id", func(c *fiber.Ctx) error {
+		c.Locals("user_id", "admin")
+		return c.Next()
+	}, UpdateBucketDetails(s))
+	req := httptest.NewRequest(fiber.MethodPatch, "/files/s/"+res.StorageID, strings.NewReader(`{"title":"Summer"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	after, err := repo.GetBucketByID(res.StorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Title == nil || *after.Title != "Summer" {
+		t.Fatalf("title %v, want Summer", after.Title)
+	}
+	if after.Description == nil || *after.Description != description || strings.Join(after.Labels, ",") != "photos,2026" {
+		t.Fatalf("fields left out were changed: description %v, labels %v", after.Description, after.Labels)
+	}
+	if *after.PasswordHash != *before.PasswordHash || after.PasswordVersion != before.PasswordVersion {
+		t.Fatal("updating the details changed the password")
+	}
+}
+
+func TestFilePathsStayInsideTheBucket(t *testing.T) {
+	s, repo, _ := newTestFileService(t)
+
+	uploads := []struct{ name, want string }{
+		{`a//b/./c/../d.txt`, "a/b/d.txt"},
+		{`..\..\etc/passwd`, "etc/passwd"},
+	}
+	parts := make([]*file.UploadPart, 0, len(uploads))
+	for _, u := range uploads {
+		parts = append(parts, &file.UploadPart{Name: u.name, Body: strings.NewReader(u.want)})
+	}
+	res, err := s.UploadFiles(context.Background(), &partsSource{parts: parts}, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range uploads {
+		if got := path.Join(res.Files[i].Path, res.Files[i].OriginalName); got != u.want {
+			t.Fatalf("uploaded as %q, stored as %q, want %q", u.name, got, u.want)
+		}
+	}
+	if err := repo.AddBucketAdmin(&local.BucketAdmin{UserID: "admin", BucketID: res.StorageID, CreatedAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Patch("/files/s/:id/d/:filename", func(c *fiber.Ctx) error {
+		c.Locals("user_id", "admin")
+		return c.Next()
+	}, MoveFile(s))
+	move := func(body string) (int, filemanager.FileInfo) {
+		req := httptest.NewRequest(fiber.MethodPatch, "/files/s/"+res.StorageID+"/d/"+res.Files[0].StringID, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info filemanager.FileInfo
+		json.NewDecoder(resp.Body).Decode(&info)
+		return resp.StatusCode, info
+	}
+
+	// A new name is only a name; folders go through path
+	for _, name := range []string{`../x.txt`, `..`, `sub/x.txt`, `sub\x.txt`} {
+		if status, _ := move(fmt.Sprintf(`{"name":%q}`, name)); status != fiber.StatusBadRequest {
+			t.Fatalf("rename to %q: status %d, want 400", name, status)
+		}
+	}
+
+	status, info := move(`{"path":"../../x//./y/"}`)
+	if status != fiber.StatusOK || info.Path != "x/y" || info.OriginalName != "d.txt" {
+		t.Fatalf("move: status %d, path %q, name %q", status, info.Path, info.OriginalName)
+	}
+	dbFile, err := repo.GetFileByStringID(res.Files[0].StringID)
+	if err != nil || dbFile == nil || dbFile.Path != "x/y" {
+		t.Fatalf("stored path after move: %v, %v", dbFile, err)
+	}
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/cthulhu-platform/gateway/internal/middleware"
+	"github.com/cthulhu-platform/gateway/internal/service/file"
+	"github.com/gofiber/fiber/v2"
+)
+
+// tusContentType is the only body type accepted for tus PATCH requests
+const tusContentType = "application/offset+octet-stream"
+
+// TusOptions advertises the tus version and extensions served under /files/tus
+func TusOptions() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Version", middleware.TusVersion)
+		c.Set("Tus-Extension", "creation,termination,checksum")
+		c.Set("Tus-Checksum-Algorithm", strings.Join(file.TusChecksumAlgorithms, ","))
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// TusCreate starts a resumable upload (creation extension).
+// Upload-Metadata carries the filename and type, an optional bucket_id to add the file to an
+// existing bucket, and the same bucket settings as a multipart upload.
+func TusCreate(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get("Upload-Defer-Length") != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Upload-Defer-Length is not supported",
+			})
+		}
+
+		length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Upload-Length must be a non-negative integer",
+			})
+		}
+
+		metadata, echo, err := parseTusMetadata(c.Get("Upload-Metadata"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		opts := file.TusCreateOptions{
+			Length:      length,
+			FileName:    firstNonEmpty(metadata["relativePath"], metadata["filename"], metadata["name"]),
+			ContentType: firstNonEmpty(metadata["filetype"], metadata["type"]),
+			Metadata:    echo,
+			BucketID:    metadata["bucket_id"],
+		}
+		opts.Claims, _ = c.Locals("bucket_claims").(*file.BucketAccessClaims)
+		if opts.BucketID == "" {
+			values := make(map[string][]string, len(metadata))
+			for key, value := range metadata {
+				values[key] = []string{value}
+			}
+			if opts.Upload, err = uploadOptionsFromForm(values); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   err.Error(),
+				})
+			}
+		}
+
+		// Extract user_id from context (optional, may be nil)
+		var userID *string
+		if uid, ok := c.Locals("user_id").(string); ok && uid != "" {
+			userID = &uid
+		}
+
+		upload, err := s.CreateTusUpload(c.UserContext(), userID, c.IP(), opts)
+		if errors.Is(err, file.ErrTusStagingFull) {
+			c.Set(fiber.HeaderRetryAfter, "60")
+		}
+		if err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusBadRequest)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		setTusUploadHeaders(c, upload)
+		c.Location("/files/tus/" + upload.ID)
+		return c.SendStatus(fiber.StatusCreated)
+	}
+}
+
+// TusHead reports how many bytes of an upload the server has. Once every byte has arrived it also
+// reports X-Bucket-Id and X-File-Id when the file is stored, or X-Upload-Error while storing it fails.
+func TusHead(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+
+		upload, err := s.GetTusUpload(c.UserContext(), c.Params("uploadId"))
+		if err != nil {
+			return c.SendStatus(fileErrorStatus(err, fiber.StatusInternalServerError))
+		}
+
+		setTusUploadHeaders(c, upload)
+		c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			c.Set("Upload-Metadata", upload.Metadata)
+		}
+		if upload.Error != "" {
+			c.Set("X-Upload-Error", upload.Error)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+// TusPatch appends a chunk to an upload. The response carries the new Upload-Offset. The file is
+// stored in the background after the last chunk, so its X-Bucket-Id and X-File-Id come from HEAD.
+func TusPatch(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get(fiber.HeaderContentType) != tusContentType {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+				"success": false,
+				"error":   "Content-Type must be " + tusContentType,
+			})
+		}
+
+		offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Upload-Offset must be a non-negative integer",
+			})
+		}
+
+		var checksum *file.TusChecksum
+		if header := c.Get("Upload-Checksum"); header != "" {
+			if checksum, err = parseTusChecksum(header); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"success": false,
+					"error":   err.Error(),
+				})
+			}
+		}
+
+		// Without a stream there is nothing left to read: c.Body only returns what fasthttp already buffered
+		body := c.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(c.Body())
+		}
+
+		upload, err := s.WriteTusChunk(c.UserContext(), c.Params("uploadId"), offset, body, checksum)
+		if err != nil {
+			// The chunk may not have been read to the end
+			c.Context().SetConnectionClose()
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		setTusUploadHeaders(c, upload)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// TusDelete terminates an upload (termination extension)
+func TusDelete(s file.FileService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := s.TerminateTusUpload(c.UserContext(), c.Params("uploadId")); err != nil {
+			return c.Status(fileErrorStatus(err, fiber.StatusInternalServerError)).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func setTusUploadHeaders(c *fiber.Ctx, upload *file.TusUpload) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.StringID != "" {
+		c.Set("X-Bucket-Id", upload.BucketID)
+		c.Set("X-File-Id", upload.StringID)
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma-separated "key base64value" pairs.
+// It also returns the header with the password pair removed, to be echoed back on HEAD.
+func parseTusMetadata(header string) (map[string]string, string, error) {
+	metadata := make(map[string]string)
+	echo := make([]string, 0)
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, "", errors.New("Upload-Metadata value of " + strconv.Quote(key) + " is not valid base64")
+		}
+		if _, dup := metadata[key]; dup {
+			return nil, "", errors.New("Upload-Metadata key " + strconv.Quote(key) + " is repeated")
+		}
+
+		metadata[key] = string(value)
+		if key != "password" {
+			echo = append(echo, pair)
+		}
+	}
+
+	return metadata, strings.Join(echo, ","), nil
+}
+
+// parseTusChecksum decodes an Upload-Checksum header of the form "algorithm base64digest"
+func parseTusChecksum(header string) (*file.TusChecksum, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, errors.New("Upload-Checksum must be an algorithm and a base64 digest")
+	}
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.New("Upload-Checksum digest is not valid base64")
+	}
+	return &file.TusChecksum{Algorithm: algorithm, Digest: digest}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+
+	"github.com/cthulhu-platform/gateway/internal/service/file"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// maxFormFieldSize caps each non-file field of a streamed multipart upload
+	maxFormFieldSize = 64 << 10
+	// maxFormFields caps how many non-file fields a streamed multipart upload may carry
+	maxFormFields = 1000
+	// contentSHA256Header carries the hex SHA-256 a client expects a file to have,
+	// either on a part of the body or on the request of a single-file upload
+	contentSHA256Header = "X-Content-SHA256"
+)
+
+// multipartSource reads a multipart/form-data request body one part at a time.
+// Parts of fileField are handed out as files; every other field is collected for Options.
+type multipartSource struct {
+	reader    *multipart.Reader
+	fileField string
+	values    map[string][]string
+	fields    int
+	part      *multipart.Part
+	done      bool
+	files     int
+	sha256    string // X-Content-SHA256 of the request, only valid for a single file
+	options   func(values map[string][]string) (file.UploadOptions, error)
+}
+
+// newMultipartSource streams the request body of c. options turns the collected form fields
+// into upload options once the body has been read; nil means the fields are ignored.
+func newMultipartSource(c *fiber.Ctx, fileField string, options func(values map[string][]string) (file.UploadOptions, error)) (*multipartSource, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, errors.New("invalid multipart payload")
+	}
+	if encoding := c.Get(fiber.HeaderContentEncoding); encoding != "" && encoding != "identity" {
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	// Without a stream there is nothing left to read: c.Body only returns what fasthttp already buffered
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	return &multipartSource{
+		reader:    multipart.NewReader(body, boundary),
+		fileField: fileField,
+		values:    make(map[string][]string),
+		sha256:    c.Get(contentSHA256Header),
+		options:   options,
+	}, nil
+}
+
+func (s *multipartSource) NextFile() (*file.UploadPart, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	if s.part != nil {
+		s.part.Close()
+		s.part = nil
+	}
+
+	for {
+		part, err := s.reader.NextPart()
+		if err == io.EOF {
+			s.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart payload: %w", err)
+		}
+
+		if part.FileName() == "" {
+			if err := s.readField(part); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if part.FormName() != s.fileField {
+			// Files sent under any other field are skipped
+			part.Close()
+			continue
+		}
+
+		// Each part may carry its own digest; the request header only covers a single-file upload
+		digest := part.Header.Get(contentSHA256Header)
+		if digest == "" && s.sha256 != "" {
+			if s.files > 0 {
+				return nil, errors.New(contentSHA256Header + " request header only applies to a single file; send it with each part instead")
+			}
+			digest = s.sha256
+		}
+		s.files++
+
+		s.part = part
+		return &file.UploadPart{
+			Name:        partFileName(part),
+			ContentType: part.Header.Get("Content-Type"),
+			Body:        part,
+			SHA256:      digest,
+		}, nil
+	}
+}
+
+func (s *multipartSource) Options() (file.UploadOptions, error) {
+	if !s.done {
+		return file.UploadOptions{}, errors.New("upload options are only known once every file has been read")
+	}
+	if s.options == nil {
+		return file.UploadOptions{}, nil
+	}
+	return s.options(s.values)
+}
+
+// release closes the connection when the body was not read to the end,
+// since the rest of it would otherwise be parsed as the next request
+func (s *multipartSource) release(c *fiber.Ctx) {
+	if !s.done {
+		c.Context().SetConnectionClose()
+	}
+}
+
+// partFileName returns the filename of a part as the client sent it, including a relative folder
+// path such as "docs/a.txt" from a folder upload. multipart.Part.FileName keeps only the last element.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+func (s *multipartSource) readField(part *multipart.Part) error {
+	defer part.Close()
+
+	s.fields++
+	if s.fields > maxFormFields {
+		return errors.New("too many form fields")
+	}
+
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+	if err != nil {
+		return fmt.Errorf("invalid multipart payload: %w", err)
+	}
+	if len(value) > maxFormFieldSize {
+		return fmt.Errorf("form field %q is too large", part.FormName())
+	}
+
+	name := part.FormName()
+	s.values[name] = append(s.values[name], string(value))
+	return nil
+}
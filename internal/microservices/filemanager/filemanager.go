@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/wagslane/go-rabbitmq"
 )
@@ -11,10 +12,17 @@ import (
 // FileInfo represents a stored object.
 type FileInfo struct {
 	OriginalName string `json:"original_name"`
+	Path         string `json:"path,omitempty"` // Folder within the bucket, e.g. "docs/img"; empty at the top level
 	StringID     string `json:"string_id"`
 	Key          string `json:"key"`
 	Size         int64  `json:"size"`
 	ContentType  string `json:"content_type"`
+	SHA256       string `json:"sha256,omitempty"` // Hex digest, empty when unknown
+
+	DeclaredContentType string `json:"declared_content_type,omitempty"` // Content-Type sent by the client, empty when none
+	ContentTypeMismatch bool   `json:"content_type_mismatch,omitempty"` // The declared type or the extension disagrees with the content
+
+	RemainingDownloads *int64 `json:"remaining_downloads,omitempty"`
 }
 
 // UploadResult is returned after an upload transaction.
@@ -25,13 +33,35 @@ type UploadResult struct {
 	StorageID     string     `json:"storage_id,omitempty"`
 	Files         []FileInfo `json:"files,omitempty"`
 	TotalSize     int64      `json:"total_size,omitempty"`
+	ExpiresAt     *int64     `json:"expires_at,omitempty"`
+
+	Rejected []RejectedFile `json:"rejected_files,omitempty"`
+}
+
+// RejectedFile is a file of an upload that was not stored.
+type RejectedFile struct {
+	OriginalName string `json:"original_name"`
+	Error        string `json:"error"`
 }
 
 // BucketMetadata contains objects under a storage ID.
 type BucketMetadata struct {
-	StorageID string     `json:"storage_id"`
-	Files     []FileInfo `json:"files"`
-	TotalSize int64      `json:"total_size"`
+	StorageID   string      `json:"storage_id"`
+	Title       *string     `json:"title,omitempty"`
+	Description *string     `json:"description,omitempty"` // Markdown
+	Labels      []string    `json:"labels"`
+	Files       []FileInfo  `json:"files"`
+	Tree        *FolderNode `json:"tree,omitempty"` // Files nested in their folders, when asked for
+	TotalSize   int64       `json:"total_size"`
+	ExpiresAt   *int64      `json:"expires_at,omitempty"`
+}
+
+// FolderNode is a folder of a bucket and everything directly in it.
+type FolderNode struct {
+	Name    string        `json:"name"`
+	Path    string        `json:"path"` // Empty for the top level
+	Folders []*FolderNode `json:"folders"`
+	Files   []FileInfo    `json:"files"`
 }
 
 // DownloadResult wraps object body and metadata for streaming.
@@ -40,6 +70,34 @@ type DownloadResult struct {
 	ContentType    string
 	ContentLength  int64
 	DownloadedFile string
+	ContentRange   string // Set for partial content, e.g. "bytes 0-99/1000"
+	AcceptRanges   bool   // Whether the object may be requested in ranges
+	LastModified   int64  // Unix timestamp used for Last-Modified and If-Range
+	SHA256         string // Hex digest of the whole file, used for ETag and Digest; empty when unknown
+	RedirectURL    string // Set when the client should fetch the object from S3 directly
+	Inline         bool   // Whether to send Content-Disposition: inline instead of attachment
+}
+
+// PresignOptions controls a presigned GetObject URL.
+type PresignOptions struct {
+	ContentDisposition string        // Sent back by S3 as Content-Disposition
+	ContentType        string        // Sent back by S3 as Content-Type
+	Expiry             time.Duration // How long the URL stays valid
+}
+
+// PresignUploadOptions controls a presigned PutObject URL.
+type PresignUploadOptions struct {
+	ContentType    string        // Content-Type the client must send with the PUT
+	ContentLength  int64         // Exact size the client must send
+	ChecksumSHA256 string        // Base64 SHA-256 the client must send as x-amz-checksum-sha256; S3 rejects other bytes
+	Expiry         time.Duration // How long the URL stays valid
+}
+
+// ObjectInfo describes a stored object as reported by HeadObject.
+type ObjectInfo struct {
+	Size           int64
+	ContentType    string
+	ChecksumSHA256 string // Base64 SHA-256 S3 checked the object against when it was put, empty when none
 }
 
 // UploadObject is a single file to upload.
@@ -54,6 +112,15 @@ type FilemanagerConnection interface {
 	Upload(ctx context.Context, storageID string, objects []UploadObject) (*UploadResult, error)
 	List(ctx context.Context, storageID string) (*BucketMetadata, error)
 	Download(ctx context.Context, storageID, filename string) (*DownloadResult, error)
+	DownloadRange(ctx context.Context, storageID, filename string, start, end int64) (*DownloadResult, error)
+	PresignDownload(ctx context.Context, storageID, filename string, opts PresignOptions) (string, error)
+	PresignUpload(ctx context.Context, storageID, filename string, opts PresignUploadOptions) (string, error)
+	Head(ctx context.Context, storageID, filename string) (*ObjectInfo, error)
+	Copy(ctx context.Context, srcStorageID, srcFilename, storageID, filename, contentType string) error
+	UploadSingleObject(ctx context.Context, storageID, stringID string, obj UploadObject) error
+	UploadStream(ctx context.Context, storageID, filename, contentType string, body io.Reader) (int64, error)
+	Delete(ctx context.Context, storageID, filename string) error
+	DeleteStorage(ctx context.Context, storageID string) error
 }
 
 type rmqFilemanagerConnection struct {
@@ -75,3 +142,39 @@ func (c *rmqFilemanagerConnection) List(ctx context.Context, storageID string) (
 func (c *rmqFilemanagerConnection) Download(ctx context.Context, storageID, filename string) (*DownloadResult, error) {
 	return nil, fmt.Errorf("rmq filemanager not implemented")
 }
+
+func (c *rmqFilemanagerConnection) DownloadRange(ctx context.Context, storageID, filename string, start, end int64) (*DownloadResult, error) {
+	return nil, fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) PresignDownload(ctx context.Context, storageID, filename string, opts PresignOptions) (string, error) {
+	return "", fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) PresignUpload(ctx context.Context, storageID, filename string, opts PresignUploadOptions) (string, error) {
+	return "", fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) Head(ctx context.Context, storageID, filename string) (*ObjectInfo, error) {
+	return nil, fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) Copy(ctx context.Context, srcStorageID, srcFilename, storageID, filename, contentType string) error {
+	return fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) UploadSingleObject(ctx context.Context, storageID, stringID string, obj UploadObject) error {
+	return fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) UploadStream(ctx context.Context, storageID, filename, contentType string, body io.Reader) (int64, error) {
+	return 0, fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) Delete(ctx context.Context, storageID, filename string) error {
+	return fmt.Errorf("rmq filemanager not implemented")
+}
+
+func (c *rmqFilemanagerConnection) DeleteStorage(ctx context.Context, storageID string) error {
+	return fmt.Errorf("rmq filemanager not implemented")
+}
@@ -1,12 +1,15 @@
 package filemanager
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -17,18 +20,30 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	// minUploadPartSize is the smallest part S3 accepts in a multipart upload, except for the last one
+	minUploadPartSize = 5 << 20
+	// maxUploadParts is the most parts a single multipart upload may have
+	maxUploadParts = 10000
+)
+
 // Local implementation uses its own S3-backed connection (e.g., LocalStack).
 type localFilemanagerConnection struct {
-	client   *s3.Client
-	bucket   string
-	idLength int
+	client    *s3.Client
+	presigner *s3.PresignClient
+	bucket    string
+	idLength  int
+	partSize  int // Bytes buffered per UploadPart
 }
 
 func NewLocalFilemanagerConnection() (*localFilemanagerConnection, error) {
+	client := newS3Client()
 	return &localFilemanagerConnection{
-		client:   newS3Client(),
-		bucket:   pkg.S3_BUCKET,
-		idLength: parseLength(pkg.S3_STORAGE_ID_LENGTH, 10),
+		client:    client,
+		presigner: s3.NewPresignClient(client),
+		bucket:    pkg.S3_BUCKET,
+		idLength:  parseLength(pkg.S3_STORAGE_ID_LENGTH, 10),
+		partSize:  max(parseLength(pkg.S3_UPLOAD_PART_SIZE_MB, 8)<<20, minUploadPartSize),
 	}, nil
 }
 
@@ -146,6 +161,110 @@ func (c *localFilemanagerConnection) UploadSingleObject(ctx context.Context, sto
 	return err
 }
 
+// UploadStream uploads body to storageID/filename without knowing its size up front.
+// A body that fits in one part is sent with a single PutObject; anything larger goes through
+// a multipart upload holding one part in memory at a time, which is aborted if any step fails.
+// It returns the number of bytes stored.
+func (c *localFilemanagerConnection) UploadStream(ctx context.Context, storageID, filename, contentType string, body io.Reader) (int64, error) {
+	if storageID == "" || filename == "" {
+		return 0, errors.New("storage id and filename are required")
+	}
+
+	key := fmt.Sprintf("%s/%s", storageID, filename)
+	buf := make([]byte, c.partSize)
+
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(c.bucket),
+			Key:           aws.String(key),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+			ContentType:   aws.String(contentType),
+		})
+		if err != nil {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	created, err := c.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(c.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := c.uploadParts(ctx, key, created.UploadId, buf, n, body)
+	if err != nil {
+		// Abort on a context of its own so a cancelled request still releases the stored parts
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		_, _ = c.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// uploadParts sends buf[:n] as the first part, then keeps refilling buf from body until it is drained
+func (c *localFilemanagerConnection) uploadParts(ctx context.Context, key string, uploadID *string, buf []byte, n int, body io.Reader) (int64, error) {
+	parts := make([]types.CompletedPart, 0)
+	size := int64(0)
+
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxUploadParts {
+			return 0, fmt.Errorf("upload exceeds %d parts of %d bytes", maxUploadParts, len(buf))
+		}
+
+		out, err := c.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(c.bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       out.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+		size += int64(n)
+
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+
+	_, err := c.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
 func (c *localFilemanagerConnection) Download(ctx context.Context, storageID, filename string) (*DownloadResult, error) {
 	if storageID == "" || filename == "" {
 		return nil, errors.New("storage id and filename are required")
@@ -165,9 +284,200 @@ func (c *localFilemanagerConnection) Download(ctx context.Context, storageID, fi
 		ContentType:    aws.ToString(obj.ContentType),
 		ContentLength:  aws.ToInt64(obj.ContentLength),
 		DownloadedFile: filename,
+		AcceptRanges:   true,
+	}, nil
+}
+
+// Delete removes a single object stored as storageID/filename
+func (c *localFilemanagerConnection) Delete(ctx context.Context, storageID, filename string) error {
+	if storageID == "" || filename == "" {
+		return errors.New("storage id and filename are required")
+	}
+
+	key := fmt.Sprintf("%s/%s", storageID, filename)
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// DeleteStorage removes every object stored under the storageID/ prefix
+func (c *localFilemanagerConnection) DeleteStorage(ctx context.Context, storageID string) error {
+	if storageID == "" {
+		return errors.New("storage id is required")
+	}
+
+	prefix := storageID + "/"
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		// A listing page holds at most 1000 keys, which is also the DeleteObjects limit
+		ids := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: obj.Key})
+		}
+
+		out, err := c.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(c.bucket),
+			Delete: &types.Delete{
+				Objects: ids,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+
+	return nil
+}
+
+// DownloadRange fetches the inclusive byte range start-end of an object with a ranged GetObject
+func (c *localFilemanagerConnection) DownloadRange(ctx context.Context, storageID, filename string, start, end int64) (*DownloadResult, error) {
+	if storageID == "" || filename == "" {
+		return nil, errors.New("storage id and filename are required")
+	}
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid byte range %d-%d", start, end)
+	}
+
+	key := fmt.Sprintf("%s/%s", storageID, filename)
+	obj, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DownloadResult{
+		Body:           obj.Body,
+		ContentType:    aws.ToString(obj.ContentType),
+		ContentLength:  aws.ToInt64(obj.ContentLength),
+		DownloadedFile: filename,
+		ContentRange:   aws.ToString(obj.ContentRange),
+		AcceptRanges:   true,
+	}, nil
+}
+
+// PresignDownload returns a short-lived GetObject URL for storageID/filename
+func (c *localFilemanagerConnection) PresignDownload(ctx context.Context, storageID, filename string, opts PresignOptions) (string, error) {
+	if storageID == "" || filename == "" {
+		return "", errors.New("storage id and filename are required")
+	}
+	if opts.Expiry <= 0 {
+		return "", errors.New("presign expiry must be positive")
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(fmt.Sprintf("%s/%s", storageID, filename)),
+	}
+	if opts.ContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(opts.ContentDisposition)
+	}
+	if opts.ContentType != "" {
+		input.ResponseContentType = aws.String(opts.ContentType)
+	}
+
+	req, err := c.presigner.PresignGetObject(ctx, input, s3.WithPresignExpires(opts.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// PresignUpload returns a short-lived PutObject URL for storageID/filename.
+// Content-Type, Content-Length and the SHA-256 checksum are signed, so the client must send exactly
+// those values, and S3 refuses a body that does not match the checksum.
+func (c *localFilemanagerConnection) PresignUpload(ctx context.Context, storageID, filename string, opts PresignUploadOptions) (string, error) {
+	if storageID == "" || filename == "" {
+		return "", errors.New("storage id and filename are required")
+	}
+	if opts.Expiry <= 0 {
+		return "", errors.New("presign expiry must be positive")
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(fmt.Sprintf("%s/%s", storageID, filename)),
+		ContentLength: aws.Int64(opts.ContentLength),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.ChecksumSHA256 != "" {
+		input.ChecksumSHA256 = aws.String(opts.ChecksumSHA256)
+	}
+
+	req, err := c.presigner.PresignPutObject(ctx, input, s3.WithPresignExpires(opts.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// Head returns the size, content type and SHA-256 checksum of storageID/filename,
+// or nil when the object does not exist
+func (c *localFilemanagerConnection) Head(ctx context.Context, storageID, filename string) (*ObjectInfo, error) {
+	if storageID == "" || filename == "" {
+		return nil, errors.New("storage id and filename are required")
+	}
+
+	out, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(fmt.Sprintf("%s/%s", storageID, filename)),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Size:           aws.ToInt64(out.ContentLength),
+		ContentType:    aws.ToString(out.ContentType),
+		ChecksumSHA256: aws.ToString(out.ChecksumSHA256),
 	}, nil
 }
 
+// Copy copies srcStorageID/srcFilename to storageID/filename inside S3, storing it with contentType.
+// The bytes never pass through the gateway; S3 copies objects of up to 5 GB this way.
+func (c *localFilemanagerConnection) Copy(ctx context.Context, srcStorageID, srcFilename, storageID, filename, contentType string) error {
+	if srcStorageID == "" || srcFilename == "" || storageID == "" || filename == "" {
+		return errors.New("storage ids and filenames are required")
+	}
+
+	_, err := c.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(c.bucket),
+		Key:               aws.String(fmt.Sprintf("%s/%s", storageID, filename)),
+		CopySource:        aws.String(fmt.Sprintf("%s/%s/%s", c.bucket, srcStorageID, srcFilename)),
+		ContentType:       aws.String(contentType),
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	return err
+}
+
 func (c *localFilemanagerConnection) prefixExists(ctx context.Context, storageID string) (bool, error) {
 	prefix := storageID + "/"
 	out, err := c.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StreamedRoute is a route whose handler streams the request body instead of reading it whole
+type StreamedRoute struct {
+	Method string
+	Path   string // Route pattern, e.g. "/files/s/:id/upload"
+}
+
+// BodyLimit rejects request bodies larger than limit bytes.
+// The server streams request bodies, so fasthttp no longer enforces its own limit. Only the streamed
+// routes are exempt, whatever the Content-Type: their handlers apply quotas while streaming instead.
+func BodyLimit(limit int, streamed ...StreamedRoute) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		for _, route := range streamed {
+			if c.Method() == route.Method && matchRoutePath(route.Path, c.Path()) {
+				return c.Next()
+			}
+		}
+
+		length := c.Request().Header.ContentLength()
+		if length > limit {
+			// The unread body would otherwise be parsed as the next request on this connection
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": "request body too large",
+			})
+		}
+
+		// Chunked bodies have no declared length, so read them here with the limit applied
+		if length == -1 {
+			if stream := c.Context().RequestBodyStream(); stream != nil {
+				body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+				if err != nil {
+					c.Context().SetConnectionClose()
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": "invalid request body",
+					})
+				}
+				if len(body) > limit {
+					c.Context().SetConnectionClose()
+					return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+						"error": "request body too large",
+					})
+				}
+				c.Request().SetBodyRaw(body)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// matchRoutePath reports whether path matches a route pattern whose ":name" segments match any single segment
+func matchRoutePath(pattern, path string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, ":") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"errors"
+
 	"github.com/cthulhu-platform/gateway/internal/service/auth"
 	"github.com/cthulhu-platform/gateway/internal/service/file"
 	"github.com/gofiber/fiber/v2"
@@ -8,7 +10,9 @@ import (
 
 // BucketPasswordAuth middleware verifies bucket access token if bucket is protected
 // X-Bucket-Password is removed for security - only X-Bucket-Access tokens are accepted
-func BucketPasswordAuth(fileService file.FileService, authService auth.AuthService) fiber.Handler {
+// The token must grant privilege, one of the file.Privilege* constants; the handlers of
+// write and delete routes accept such a token in place of a logged-in bucket admin
+func BucketPasswordAuth(fileService file.FileService, authService auth.AuthService, privilege string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		storageID := c.Params("id")
 		if storageID == "" {
@@ -18,68 +22,149 @@ func BucketPasswordAuth(fileService file.FileService, authService auth.AuthServi
 			})
 		}
 
-		// Get bucket to check if it's protected
-		isProtected, _, err := fileService.IsBucketProtected(c.UserContext(), storageID)
-		if err != nil {
-			return c.Status(404).JSON(fiber.Map{
+		if ok, err := checkBucketAccess(c, fileService, authService, storageID, privilege); !ok {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// BucketDownloadAuth guards the download route. A share link (?link=) opens the file it was made for
+// in place of the bucket password, and is handed to the handler to be counted with the download;
+// without one it is BucketPasswordAuth with the read privilege.
+func BucketDownloadAuth(fileService file.FileService, authService auth.AuthService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		storageID, stringID := c.Params("id"), c.Params("filename")
+		if storageID == "" || stringID == "" {
+			return c.Status(400).JSON(fiber.Map{
 				"success": false,
-				"error":   "bucket not found",
+				"error":   "storage id and string id required",
 			})
 		}
 
-		// If not protected, allow access
-		if !isProtected {
+		link := c.Query("link")
+		if link == "" {
+			if ok, err := checkBucketAccess(c, fileService, authService, storageID, file.PrivilegeRead); !ok {
+				return err
+			}
 			return c.Next()
 		}
 
-		// If protected, require bucket access token
-		accessToken := c.Get("X-Bucket-Access")
-		if accessToken == "" {
-			return c.Status(401).JSON(fiber.Map{
+		// The link is checked against the requested file before anything else, bucket protection included
+		linkID, err := fileService.CheckShareLink(c.UserContext(), storageID, stringID, link)
+		switch {
+		case err == nil:
+			c.Locals("share_link_id", linkID)
+			return c.Next()
+		case errors.Is(err, file.ErrShareLinkExpired), errors.Is(err, file.ErrDownloadLimitReached), errors.Is(err, file.ErrBucketExpired):
+			return c.Status(410).JSON(fiber.Map{
 				"success": false,
-				"error":   "bucket access token required",
+				"error":   err.Error(),
 			})
-		}
-
-		// Validate bucket access token
-		claims, err := file.ValidateBucketAccessToken(accessToken)
-		if err != nil {
+		default:
 			return c.Status(401).JSON(fiber.Map{
 				"success": false,
-				"error":   "invalid or expired bucket access token",
+				"error":   "invalid or revoked share link",
 			})
 		}
+	}
+}
 
-		// Verify bucket_id matches
-		if claims.BucketID != storageID {
-			return c.Status(401).JSON(fiber.Map{
-				"success": false,
-				"error":   "token bucket_id mismatch",
-			})
-		}
+// checkBucketAccess runs the checks of BucketPasswordAuth against storageID.
+// When access is refused it has already written the response, and returns false with the handler's error.
+func checkBucketAccess(c *fiber.Ctx, fileService file.FileService, authService auth.AuthService, storageID, privilege string) (bool, error) {
+	// Get bucket to check if it's protected
+	isProtected, passwordVersion, err := fileService.IsBucketProtected(c.UserContext(), storageID)
+	if errors.Is(err, file.ErrBucketExpired) {
+		return false, c.Status(410).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket expired",
+		})
+	}
+	if err != nil {
+		return false, c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket not found",
+		})
+	}
+
+	// An open bucket can be read by anyone. Changing it takes a bucket admin or a token granting the
+	// privilege, so a token sent along is still checked and handed on to the handler.
+	accessToken := c.Get("X-Bucket-Access")
+	if !isProtected && (privilege == file.PrivilegeRead || accessToken == "") {
+		return true, nil
+	}
+
+	// If protected, require bucket access token
+	if accessToken == "" {
+		return false, c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket access token required",
+		})
+	}
 
-		// Optional: If token has auth_token_id, validate auth token is still valid
-		if claims.AuthTokenID != nil && authService != nil {
-			authHeader := c.Get("Authorization")
-			if authHeader != "" && len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-				authToken := authHeader[7:]
-				authClaims, err := authService.ValidateToken(authToken)
-				if err != nil {
-					return c.Status(401).JSON(fiber.Map{
-						"success": false,
-						"error":   "linked auth token is invalid",
-					})
-				}
-				// Verify JTI matches
-				if authClaims.ID != *claims.AuthTokenID {
-					return c.Status(401).JSON(fiber.Map{
-						"success": false,
-						"error":   "auth token mismatch",
-					})
-				}
+	// Validate bucket access token
+	claims, err := file.ValidateBucketAccessToken(accessToken)
+	if err != nil {
+		return false, c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "invalid or expired bucket access token",
+		})
+	}
+
+	// Verify bucket_id matches
+	if claims.BucketID != storageID {
+		return false, c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "token bucket_id mismatch",
+		})
+	}
+
+	// Tokens issued before the password last changed no longer grant access
+	if claims.PasswordVersion != passwordVersion {
+		return false, c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket password has changed",
+		})
+	}
+
+	// Revoked tokens are cut off before they expire
+	if err := fileService.CheckBucketToken(c.UserContext(), storageID, claims.ID); err != nil {
+		return false, c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket access token has been revoked",
+		})
+	}
+
+	if !claims.Allows(privilege) {
+		return false, c.Status(403).JSON(fiber.Map{
+			"success": false,
+			"error":   "bucket access token does not grant the " + privilege + " privilege",
+		})
+	}
+
+	// Optional: If token has auth_token_id, validate auth token is still valid
+	if claims.AuthTokenID != nil && authService != nil {
+		authHeader := c.Get("Authorization")
+		if authHeader != "" && len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+			authToken := authHeader[7:]
+			authClaims, err := authService.ValidateToken(authToken)
+			if err != nil {
+				return false, c.Status(401).JSON(fiber.Map{
+					"success": false,
+					"error":   "linked auth token is invalid",
+				})
+			}
+			// Verify JTI matches
+			if authClaims.ID != *claims.AuthTokenID {
+				return false, c.Status(401).JSON(fiber.Map{
+					"success": false,
+					"error":   "auth token mismatch",
+				})
 			}
 		}
-
-		return c.Next()
 	}
+
+	c.Locals("bucket_claims", claims)
+	return true, nil
 }
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/cthulhu-platform/gateway/internal/service/auth"
+	"github.com/cthulhu-platform/gateway/internal/service/file"
+	"github.com/gofiber/fiber/v2"
+)
+
+// TusVersion is the tus protocol version served under /files/tus
+const TusVersion = "1.0.0"
+
+// TusResumable middleware answers every tus request with Tus-Resumable and rejects
+// clients speaking another protocol version; OPTIONS is exempt so clients can discover it
+func TusResumable() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", TusVersion)
+
+		if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != TusVersion {
+			c.Set("Tus-Version", TusVersion)
+			return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+				"error": "unsupported tus version",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// TusBucketAuth guards tus uploads into an existing bucket, named by the bucket_id pair of
+// Upload-Metadata, like the bucket's upload route: a protected bucket needs a token with the
+// write privilege, and the service then takes either that token or a logged-in bucket admin.
+// Uploads creating a new bucket pass through. It runs after OptionalJWTAuth.
+func TusBucketAuth(fileService file.FileService, authService auth.AuthService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		bucketID := tusMetadataValue(c.Get("Upload-Metadata"), "bucket_id")
+		if bucketID == "" {
+			return c.Next()
+		}
+
+		if ok, err := checkBucketAccess(c, fileService, authService, bucketID, file.PrivilegeWrite); !ok {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// tusMetadataValue decodes the value of key in an Upload-Metadata header, or returns "" when it is
+// missing or malformed; the handler rejects malformed metadata itself
+func tusMetadataValue(header, key string) string {
+	for _, pair := range strings.Split(header, ",") {
+		k, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k != key {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+	return ""
+}
@@ -5,6 +5,7 @@ import (
 )
 
 const (
+	// BODY_LIMIT_MB caps request bodies that are read whole; multipart uploads are streamed and exempt
 	BODY_LIMIT_MB = 500
 )
 
@@ -22,6 +23,33 @@ var (
 	S3_FORCE_PATH_STYLE  = env.GetEnv("S3_FORCE_PATH_STYLE", "true")
 	S3_STORAGE_ID_LENGTH = env.GetEnv("S3_STORAGE_ID_LENGTH", "10")
 
+	// Uploads: lifetime of presigned PutObject URLs for direct-to-S3 uploads
+	S3_PRESIGN_UPLOAD_EXPIRY = env.GetEnv("S3_PRESIGN_UPLOAD_EXPIRY", "1h")
+	// Uploads: size of each buffered part when streaming uploads into S3 multipart uploads (minimum 5)
+	S3_UPLOAD_PART_SIZE_MB = env.GetEnv("S3_UPLOAD_PART_SIZE_MB", "8")
+	// Uploads: idle time after which an unfinished tus upload and its staged bytes are discarded
+	TUS_UPLOAD_EXPIRY = env.GetEnv("TUS_UPLOAD_EXPIRY", "24h")
+	// Uploads: largest Upload-Length a tus upload may declare, whatever the quota allows, as it is staged on local disk
+	TUS_MAX_SIZE_MB = env.GetEnv("TUS_MAX_SIZE_MB", "5120")
+	// Uploads: total Upload-Length of all unfinished tus uploads together, as every one is staged on local disk
+	TUS_STAGING_MAX_MB = env.GetEnv("TUS_STAGING_MAX_MB", "51200")
+
+	// Downloads: "true" redirects to a presigned S3 URL instead of proxying bytes through the gateway
+	DOWNLOAD_REDIRECT        = env.GetEnv("DOWNLOAD_REDIRECT", "false")
+	DOWNLOAD_REDIRECT_EXPIRY = env.GetEnv("DOWNLOAD_REDIRECT_EXPIRY", "5m")
+
+	// Quotas for logged-in users: total storage, buckets created and size of a single file; 0 = unlimited
+	QUOTA_USER_STORAGE_MB   = env.GetEnv("QUOTA_USER_STORAGE_MB", "10240")
+	QUOTA_USER_BUCKETS      = env.GetEnv("QUOTA_USER_BUCKETS", "100")
+	QUOTA_USER_FILE_SIZE_MB = env.GetEnv("QUOTA_USER_FILE_SIZE_MB", "5120")
+	// Quotas for anonymous uploads, counted per client IP; 0 = unlimited
+	QUOTA_ANONYMOUS_STORAGE_MB   = env.GetEnv("QUOTA_ANONYMOUS_STORAGE_MB", "1024")
+	QUOTA_ANONYMOUS_BUCKETS      = env.GetEnv("QUOTA_ANONYMOUS_BUCKETS", "20")
+	QUOTA_ANONYMOUS_FILE_SIZE_MB = env.GetEnv("QUOTA_ANONYMOUS_FILE_SIZE_MB", "512")
+
+	// Bucket lifecycle
+	BUCKET_REAPER_INTERVAL = env.GetEnv("BUCKET_REAPER_INTERVAL", "1m")
+
 	// AMQP config
 	AMPQ_USER  = env.GetEnv("AMQP_USER", "guest")
 	AMPQ_PASS  = env.GetEnv("AMQP_PASS", "guest")
@@ -3,8 +3,11 @@ package local
 import (
 	"database/sql"
 	"embed"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/cthulhu-platform/gateway/internal/pkg"
 	_ "modernc.org/sqlite"
@@ -13,25 +16,103 @@ import (
 //go:embed sql/file/schema.sql
 var fileSchemaFS embed.FS
 
+// fileColumnMigrations lists columns added to the file schema after its tables were first created
+var fileColumnMigrations = []columnMigration{
+	{table: "buckets", column: "expires_at", definition: "INTEGER"},
+	{table: "buckets", column: "max_downloads", definition: "INTEGER"},
+	{table: "buckets", column: "burn_after_reading", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "buckets", column: "uploader_ip", definition: "TEXT"},
+	// Buckets created before owner_id existed are owned by their oldest admin
+	{table: "buckets", column: "owner_id", definition: "TEXT", backfill: `UPDATE buckets SET owner_id = (
+	    SELECT user_id FROM bucket_admins WHERE bucket_admins.bucket_id = buckets.id ORDER BY created_at ASC LIMIT 1
+	)`},
+	{table: "buckets", column: "password_version", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "buckets", column: "title", definition: "TEXT"},
+	{table: "buckets", column: "description", definition: "TEXT"},
+	{table: "buckets", column: "labels", definition: "TEXT"},
+	{table: "files", column: "max_downloads", definition: "INTEGER"},
+	{table: "files", column: "download_count", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "files", column: "sha256", definition: "TEXT"},
+	{table: "files", column: "declared_content_type", definition: "TEXT"},
+	{table: "files", column: "content_type_mismatch", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "files", column: "path", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "pending_files", column: "sha256", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "tus_uploads", column: "client_ip", definition: "TEXT"},
+	{table: "tus_uploads", column: "bucket_title", definition: "TEXT"},
+	{table: "tus_uploads", column: "bucket_description", definition: "TEXT"},
+	{table: "tus_uploads", column: "bucket_labels", definition: "TEXT"},
+}
+
 type FileRepository interface {
 	GetDB() *sql.DB
 	Close() error
 	// Bucket operations
 	CreateBucket(bucket *Bucket) error
 	GetBucketByID(bucketID string) (*Bucket, error)
-	UpdateBucket(bucket *Bucket) error
+	UpdateBucketDetails(bucket *Bucket) error
+	SetBucketPassword(bucketID string, passwordHash *string, updatedAt int64) error
+	SetBucketOwner(bucketID, ownerID string) error
+	DeleteBucket(bucketID string) error
+	GetExpiredBuckets(now int64) ([]*Bucket, error)
+	// Usage operations
+	GetUserUsage(userID string) (*Usage, error)
+	GetAnonymousUsage(clientIP string) (*Usage, error)
 	// File operations
 	CreateFile(file *File) error
 	GetFileByID(id int64) (*File, error)
 	GetFileByStringID(stringID string) (*File, error)
 	GetFilesByBucketID(bucketID string) ([]*File, error)
 	GetFileByBucketIDAndOriginalName(bucketID, originalName string) (*File, error)
+	UpdateFile(file *File) error
+	MoveFile(id int64, path, originalName string) error
+	DeleteFile(id int64) error
+	ConsumeDownload(fileID int64) (int64, bool, error)
+	// Blob operations
+	AcquireBlob(blob *Blob) (*Blob, error)
+	ReferenceBlob(sha256 string) (*Blob, error)
+	ReleaseBlob(s3Key string) error
+	DeleteUnreferencedBlobs() ([]*Blob, error)
 	// Bucket admin operations
 	AddBucketAdmin(admin *BucketAdmin) error
 	RemoveBucketAdmin(userID, bucketID string) error
 	GetBucketAdminsByBucketID(bucketID string) ([]*BucketAdmin, error)
 	GetBucketAdminsByUserID(userID string) ([]*BucketAdmin, error)
+	GetBucketSummariesByUserID(userID string, page BucketPage, now int64) ([]*BucketSummary, int64, error)
 	IsBucketAdmin(userID, bucketID string) (bool, error)
+	// Share link operations
+	CreateShareLink(link *ShareLink) error
+	GetShareLinkByID(id string) (*ShareLink, error)
+	GetShareLinksByFileID(fileID int64) ([]*ShareLink, error)
+	DeleteShareLink(id string) error
+	ConsumeShareLinkDownload(id string) (bool, error)
+	// Bucket token operations
+	CreateBucketToken(token *BucketToken) error
+	GetBucketToken(id string) (*BucketToken, error)
+	GetActiveBucketTokens(bucketID string, now int64) ([]*BucketToken, error)
+	RevokeBucketToken(bucketID, id string, now int64) (bool, error)
+	RevokeBucketTokens(bucketID string, now int64) (int64, error)
+	DeleteExpiredBucketTokens(now int64) (int64, error)
+	// Failed password attempt operations
+	GetAuthFailure(scope, key string) (*AuthFailure, error)
+	RecordAuthFailure(scope, key string, now, windowStart int64) (int64, error)
+	LockAuthFailure(scope, key string, lockedUntil int64) error
+	ClearAuthFailure(scope, key string) error
+	DeleteStaleAuthFailures(windowStart, now int64) (int64, error)
+	CreateBucketLockout(lockout *BucketLockout) error
+	GetBucketLockouts(bucketID string, limit int) ([]*BucketLockout, error)
+	// Upload session operations
+	CreateUploadSession(session *UploadSession, files []*PendingFile) error
+	GetUploadSession(bucketID string) (*UploadSession, error)
+	GetExpiredUploadSessions(now int64) ([]*UploadSession, error)
+	DeleteUploadSession(bucketID string) error
+	GetPendingFilesByBucketID(bucketID string) ([]*PendingFile, error)
+	// Tus upload operations
+	CreateTusUpload(upload *TusUpload) error
+	GetTusUpload(id string) (*TusUpload, error)
+	UpdateTusUpload(upload *TusUpload) error
+	DeleteTusUpload(id string) error
+	GetExpiredTusUploads(now int64) ([]*TusUpload, error)
+	GetTusStagingBytes() (int64, error)
 }
 
 type localFileRepository struct {
@@ -47,8 +128,10 @@ func NewLocalFileRepository() (*localFileRepository, error) {
 		return nil, err
 	}
 
-	// Open SQLite database connection
-	db, err := sql.Open("sqlite", path)
+	// Open SQLite database connection. foreign_keys is a per-connection pragma,
+	// so it is set in the DSN to make ON DELETE CASCADE apply on every pooled connection.
+	// busy_timeout lets background jobs such as the expiry reaper wait for the write lock.
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +142,12 @@ func NewLocalFileRepository() (*localFileRepository, error) {
 		return nil, err
 	}
 
+	// Bring existing tables up to date before the schema creates indexes on new columns
+	if err := migrateColumns(db, fileColumnMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	// Initialize schema
 	schema, err := fileSchemaFS.ReadFile("sql/file/schema.sql")
 	if err != nil {
@@ -92,22 +181,36 @@ func (r *localFileRepository) Close() error {
 // Bucket operations
 
 func (r *localFileRepository) CreateBucket(bucket *Bucket) error {
-	query := `INSERT INTO buckets (id, password_hash, created_at, updated_at)
-	          VALUES (?, ?, ?, ?)`
+	labels, err := encodeLabels(bucket.Labels)
+	if err != nil {
+		return err
+	}
 
-	_, err := r.db.Exec(query, bucket.ID, bucket.PasswordHash, bucket.CreatedAt, bucket.UpdatedAt)
+	query := `INSERT INTO buckets (id, password_hash, password_version, created_at, updated_at, expires_at, max_downloads, burn_after_reading, uploader_ip, owner_id,
+	                               title, description, labels)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = r.db.Exec(query,
+		bucket.ID, bucket.PasswordHash, bucket.PasswordVersion, bucket.CreatedAt, bucket.UpdatedAt, bucket.ExpiresAt,
+		bucket.DefaultMaxDownloads, bucket.BurnAfterReading, bucket.UploaderIP, bucket.OwnerID,
+		bucket.Title, bucket.Description, labels,
+	)
 	return err
 }
 
 func (r *localFileRepository) GetBucketByID(bucketID string) (*Bucket, error) {
-	query := `SELECT id, password_hash, created_at, updated_at
+	query := `SELECT id, password_hash, password_version, created_at, updated_at, expires_at, max_downloads, burn_after_reading, uploader_ip, owner_id,
+	                 title, description, labels
 	          FROM buckets WHERE id = ? LIMIT 1`
 
 	bucket := &Bucket{}
-	var passwordHash sql.NullString
+	var passwordHash, uploaderIP, ownerID, title, description, labels sql.NullString
+	var expiresAt, maxDownloads sql.NullInt64
 
 	err := r.db.QueryRow(query, bucketID).Scan(
-		&bucket.ID, &passwordHash, &bucket.CreatedAt, &bucket.UpdatedAt,
+		&bucket.ID, &passwordHash, &bucket.PasswordVersion, &bucket.CreatedAt, &bucket.UpdatedAt, &expiresAt,
+		&maxDownloads, &bucket.BurnAfterReading, &uploaderIP, &ownerID,
+		&title, &description, &labels,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -119,40 +222,224 @@ func (r *localFileRepository) GetBucketByID(bucketID string) (*Bucket, error) {
 	if passwordHash.Valid {
 		bucket.PasswordHash = &passwordHash.String
 	}
+	if expiresAt.Valid {
+		bucket.ExpiresAt = &expiresAt.Int64
+	}
+	if maxDownloads.Valid {
+		bucket.DefaultMaxDownloads = &maxDownloads.Int64
+	}
+	if uploaderIP.Valid {
+		bucket.UploaderIP = &uploaderIP.String
+	}
+	if ownerID.Valid {
+		bucket.OwnerID = &ownerID.String
+	}
+	if title.Valid {
+		bucket.Title = &title.String
+	}
+	if description.Valid {
+		bucket.Description = &description.String
+	}
+	if bucket.Labels, err = decodeLabels(labels); err != nil {
+		return nil, err
+	}
 
 	return bucket, nil
 }
 
-func (r *localFileRepository) UpdateBucket(bucket *Bucket) error {
-	query := `UPDATE buckets SET password_hash = ?, updated_at = ? WHERE id = ?`
+// UpdateBucketDetails writes only the descriptive fields of a bucket, leaving its password
+// and settings as they are in the database rather than as they were when the row was read
+func (r *localFileRepository) UpdateBucketDetails(bucket *Bucket) error {
+	labels, err := encodeLabels(bucket.Labels)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE buckets SET title = ?, description = ?, labels = ?, updated_at = ? WHERE id = ?`
+
+	_, err = r.db.Exec(query, bucket.Title, bucket.Description, labels, bucket.UpdatedAt, bucket.ID)
+	return err
+}
+
+// SetBucketPassword replaces a bucket's password hash, nil removing it, and bumps its password version
+// in the same statement, so concurrent changes each invalidate the tokens issued before them
+func (r *localFileRepository) SetBucketPassword(bucketID string, passwordHash *string, updatedAt int64) error {
+	query := `UPDATE buckets SET password_hash = ?, password_version = password_version + 1, updated_at = ?
+	          WHERE id = ?`
+
+	_, err := r.db.Exec(query, passwordHash, updatedAt, bucketID)
+	return err
+}
+
+// SetBucketOwner hands a bucket to another of its admins
+func (r *localFileRepository) SetBucketOwner(bucketID, ownerID string) error {
+	query := `UPDATE buckets SET owner_id = ? WHERE id = ?`
+
+	_, err := r.db.Exec(query, ownerID, bucketID)
+	return err
+}
+
+func (r *localFileRepository) DeleteBucket(bucketID string) error {
+	query := `DELETE FROM buckets WHERE id = ?`
 
-	_, err := r.db.Exec(query, bucket.PasswordHash, bucket.UpdatedAt, bucket.ID)
+	_, err := r.db.Exec(query, bucketID)
 	return err
 }
 
+func (r *localFileRepository) GetExpiredBuckets(now int64) ([]*Bucket, error) {
+	query := `SELECT id, password_hash, password_version, created_at, updated_at, expires_at, max_downloads, burn_after_reading, uploader_ip, owner_id,
+	                 title, description, labels
+	          FROM buckets WHERE expires_at IS NOT NULL AND expires_at <= ? ORDER BY expires_at ASC`
+
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]*Bucket, 0)
+	for rows.Next() {
+		bucket := &Bucket{}
+		var passwordHash, uploaderIP, ownerID, title, description, labels sql.NullString
+		var expiresAt, maxDownloads sql.NullInt64
+
+		err := rows.Scan(
+			&bucket.ID, &passwordHash, &bucket.PasswordVersion, &bucket.CreatedAt, &bucket.UpdatedAt, &expiresAt,
+			&maxDownloads, &bucket.BurnAfterReading, &uploaderIP, &ownerID,
+			&title, &description, &labels,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if passwordHash.Valid {
+			bucket.PasswordHash = &passwordHash.String
+		}
+		if expiresAt.Valid {
+			bucket.ExpiresAt = &expiresAt.Int64
+		}
+		if maxDownloads.Valid {
+			bucket.DefaultMaxDownloads = &maxDownloads.Int64
+		}
+		if uploaderIP.Valid {
+			bucket.UploaderIP = &uploaderIP.String
+		}
+		if ownerID.Valid {
+			bucket.OwnerID = &ownerID.String
+		}
+		if title.Valid {
+			bucket.Title = &title.String
+		}
+		if description.Valid {
+			bucket.Description = &description.String
+		}
+		if bucket.Labels, err = decodeLabels(labels); err != nil {
+			return nil, err
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// Usage operations
+
+// GetUserUsage totals the files a user uploaded, their open uploads and the buckets they own
+func (r *localFileRepository) GetUserUsage(userID string) (*Usage, error) {
+	usage := &Usage{}
+
+	query := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE owner_id = ?`
+	if err := r.db.QueryRow(query, userID).Scan(&usage.Files, &usage.Bytes); err != nil {
+		return nil, err
+	}
+
+	// Open presigned and tus uploads hold the size they declared until they finish or are reaped,
+	// so several of them cannot together outgrow the quota
+	var inFlight int64
+	query = `SELECT COALESCE((SELECT SUM(p.size) FROM pending_files p
+	                           JOIN upload_sessions us ON us.bucket_id = p.bucket_id
+	                           WHERE us.owner_id = ?), 0)
+	              + COALESCE((SELECT SUM(upload_length) FROM tus_uploads
+	                           WHERE owner_id = ? AND string_id IS NULL), 0)`
+	if err := r.db.QueryRow(query, userID, userID).Scan(&inFlight); err != nil {
+		return nil, err
+	}
+	usage.Bytes += inFlight
+
+	query = `SELECT COUNT(*) FROM buckets WHERE owner_id = ?`
+	if err := r.db.QueryRow(query, userID).Scan(&usage.Buckets); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// GetAnonymousUsage totals the buckets uploaded anonymously from a client IP, the files in them and its open uploads
+func (r *localFileRepository) GetAnonymousUsage(clientIP string) (*Usage, error) {
+	usage := &Usage{}
+
+	query := `SELECT COUNT(f.id), COALESCE(SUM(f.size), 0)
+	          FROM files f JOIN buckets b ON b.id = f.bucket_id
+	          WHERE b.uploader_ip = ? AND f.owner_id IS NULL`
+	if err := r.db.QueryRow(query, clientIP).Scan(&usage.Files, &usage.Bytes); err != nil {
+		return nil, err
+	}
+
+	var inFlight int64
+	query = `SELECT COALESCE((SELECT SUM(p.size) FROM pending_files p
+	                           JOIN upload_sessions us ON us.bucket_id = p.bucket_id
+	                           JOIN buckets b ON b.id = p.bucket_id
+	                           WHERE b.uploader_ip = ? AND us.owner_id IS NULL), 0)
+	              + COALESCE((SELECT SUM(upload_length) FROM tus_uploads
+	                           WHERE client_ip = ? AND owner_id IS NULL AND string_id IS NULL), 0)`
+	if err := r.db.QueryRow(query, clientIP, clientIP).Scan(&inFlight); err != nil {
+		return nil, err
+	}
+	usage.Bytes += inFlight
+
+	query = `SELECT COUNT(*) FROM buckets WHERE uploader_ip = ?`
+	if err := r.db.QueryRow(query, clientIP).Scan(&usage.Buckets); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
 // File operations
 
 func (r *localFileRepository) CreateFile(file *File) error {
-	query := `INSERT INTO files (string_id, bucket_id, original_name, owner_id, size, content_type, s3_key, created_at)
-	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO files (string_id, bucket_id, original_name, path, owner_id, size, content_type, s3_key, created_at, max_downloads, sha256,
+	                             declared_content_type, content_type_mismatch)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	_, err := r.db.Exec(query,
-		file.StringID, file.BucketID, file.OriginalName, file.OwnerID,
-		file.Size, file.ContentType, file.S3Key, file.CreatedAt,
+		file.StringID, file.BucketID, file.OriginalName, file.Path, file.OwnerID,
+		file.Size, file.ContentType, file.S3Key, file.CreatedAt, file.MaxDownloads, file.SHA256,
+		file.DeclaredContentType, file.ContentTypeMismatch,
 	)
 	return err
 }
 
 func (r *localFileRepository) GetFileByID(id int64) (*File, error) {
-	query := `SELECT id, string_id, bucket_id, original_name, owner_id, size, content_type, s3_key, created_at
+	query := `SELECT id, string_id, bucket_id, original_name, path, owner_id, size, content_type, s3_key, created_at,
+	                 max_downloads, download_count, sha256, declared_content_type, content_type_mismatch
 	          FROM files WHERE id = ? LIMIT 1`
 
 	file := &File{}
 	var ownerID sql.NullString
+	var maxDownloads sql.NullInt64
+	var sha256 sql.NullString
+	var declaredContentType sql.NullString
 
 	err := r.db.QueryRow(query, id).Scan(
-		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName,
+		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName, &file.Path,
 		&ownerID, &file.Size, &file.ContentType, &file.S3Key, &file.CreatedAt,
+		&maxDownloads, &file.DownloadCount, &sha256, &declaredContentType, &file.ContentTypeMismatch,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -164,20 +451,34 @@ func (r *localFileRepository) GetFileByID(id int64) (*File, error) {
 	if ownerID.Valid {
 		file.OwnerID = &ownerID.String
 	}
+	if maxDownloads.Valid {
+		file.MaxDownloads = &maxDownloads.Int64
+	}
+	if sha256.Valid {
+		file.SHA256 = &sha256.String
+	}
+	if declaredContentType.Valid {
+		file.DeclaredContentType = &declaredContentType.String
+	}
 
 	return file, nil
 }
 
 func (r *localFileRepository) GetFileByStringID(stringID string) (*File, error) {
-	query := `SELECT id, string_id, bucket_id, original_name, owner_id, size, content_type, s3_key, created_at
+	query := `SELECT id, string_id, bucket_id, original_name, path, owner_id, size, content_type, s3_key, created_at,
+	                 max_downloads, download_count, sha256, declared_content_type, content_type_mismatch
 	          FROM files WHERE string_id = ? LIMIT 1`
 
 	file := &File{}
 	var ownerID sql.NullString
+	var maxDownloads sql.NullInt64
+	var sha256 sql.NullString
+	var declaredContentType sql.NullString
 
 	err := r.db.QueryRow(query, stringID).Scan(
-		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName,
+		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName, &file.Path,
 		&ownerID, &file.Size, &file.ContentType, &file.S3Key, &file.CreatedAt,
+		&maxDownloads, &file.DownloadCount, &sha256, &declaredContentType, &file.ContentTypeMismatch,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -189,12 +490,22 @@ func (r *localFileRepository) GetFileByStringID(stringID string) (*File, error)
 	if ownerID.Valid {
 		file.OwnerID = &ownerID.String
 	}
+	if maxDownloads.Valid {
+		file.MaxDownloads = &maxDownloads.Int64
+	}
+	if sha256.Valid {
+		file.SHA256 = &sha256.String
+	}
+	if declaredContentType.Valid {
+		file.DeclaredContentType = &declaredContentType.String
+	}
 
 	return file, nil
 }
 
 func (r *localFileRepository) GetFilesByBucketID(bucketID string) ([]*File, error) {
-	query := `SELECT id, string_id, bucket_id, original_name, owner_id, size, content_type, s3_key, created_at
+	query := `SELECT id, string_id, bucket_id, original_name, path, owner_id, size, content_type, s3_key, created_at,
+	                 max_downloads, download_count, sha256, declared_content_type, content_type_mismatch
 	          FROM files WHERE bucket_id = ? ORDER BY created_at ASC`
 
 	rows, err := r.db.Query(query, bucketID)
@@ -207,10 +518,14 @@ func (r *localFileRepository) GetFilesByBucketID(bucketID string) ([]*File, erro
 	for rows.Next() {
 		file := &File{}
 		var ownerID sql.NullString
+		var maxDownloads sql.NullInt64
+		var sha256 sql.NullString
+		var declaredContentType sql.NullString
 
 		err := rows.Scan(
-			&file.ID, &file.StringID, &file.BucketID, &file.OriginalName,
+			&file.ID, &file.StringID, &file.BucketID, &file.OriginalName, &file.Path,
 			&ownerID, &file.Size, &file.ContentType, &file.S3Key, &file.CreatedAt,
+			&maxDownloads, &file.DownloadCount, &sha256, &declaredContentType, &file.ContentTypeMismatch,
 		)
 		if err != nil {
 			return nil, err
@@ -219,6 +534,15 @@ func (r *localFileRepository) GetFilesByBucketID(bucketID string) ([]*File, erro
 		if ownerID.Valid {
 			file.OwnerID = &ownerID.String
 		}
+		if maxDownloads.Valid {
+			file.MaxDownloads = &maxDownloads.Int64
+		}
+		if sha256.Valid {
+			file.SHA256 = &sha256.String
+		}
+		if declaredContentType.Valid {
+			file.DeclaredContentType = &declaredContentType.String
+		}
 
 		files = append(files, file)
 	}
@@ -231,15 +555,20 @@ func (r *localFileRepository) GetFilesByBucketID(bucketID string) ([]*File, erro
 }
 
 func (r *localFileRepository) GetFileByBucketIDAndOriginalName(bucketID, originalName string) (*File, error) {
-	query := `SELECT id, string_id, bucket_id, original_name, owner_id, size, content_type, s3_key, created_at
+	query := `SELECT id, string_id, bucket_id, original_name, path, owner_id, size, content_type, s3_key, created_at,
+	                 max_downloads, download_count, sha256, declared_content_type, content_type_mismatch
 	          FROM files WHERE bucket_id = ? AND original_name = ? LIMIT 1`
 
 	file := &File{}
 	var ownerID sql.NullString
+	var maxDownloads sql.NullInt64
+	var sha256 sql.NullString
+	var declaredContentType sql.NullString
 
 	err := r.db.QueryRow(query, bucketID, originalName).Scan(
-		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName,
+		&file.ID, &file.StringID, &file.BucketID, &file.OriginalName, &file.Path,
 		&ownerID, &file.Size, &file.ContentType, &file.S3Key, &file.CreatedAt,
+		&maxDownloads, &file.DownloadCount, &sha256, &declaredContentType, &file.ContentTypeMismatch,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -251,10 +580,65 @@ func (r *localFileRepository) GetFileByBucketIDAndOriginalName(bucketID, origina
 	if ownerID.Valid {
 		file.OwnerID = &ownerID.String
 	}
+	if maxDownloads.Valid {
+		file.MaxDownloads = &maxDownloads.Int64
+	}
+	if sha256.Valid {
+		file.SHA256 = &sha256.String
+	}
+	if declaredContentType.Valid {
+		file.DeclaredContentType = &declaredContentType.String
+	}
 
 	return file, nil
 }
 
+func (r *localFileRepository) UpdateFile(file *File) error {
+	query := `UPDATE files SET string_id = ?, original_name = ?, size = ?, content_type = ?, s3_key = ?, created_at = ?,
+	                 download_count = ?, sha256 = ?, declared_content_type = ?, content_type_mismatch = ?
+	          WHERE id = ?`
+
+	_, err := r.db.Exec(query,
+		file.StringID, file.OriginalName, file.Size, file.ContentType, file.S3Key, file.CreatedAt,
+		file.DownloadCount, file.SHA256, file.DeclaredContentType, file.ContentTypeMismatch, file.ID,
+	)
+	return err
+}
+
+// MoveFile renames a file and moves it to folder path. The string_id, and so every link to the file, stays the same.
+func (r *localFileRepository) MoveFile(id int64, path, originalName string) error {
+	query := `UPDATE files SET path = ?, original_name = ? WHERE id = ?`
+
+	_, err := r.db.Exec(query, path, originalName, id)
+	return err
+}
+
+func (r *localFileRepository) DeleteFile(id int64) error {
+	query := `DELETE FROM files WHERE id = ?`
+
+	_, err := r.db.Exec(query, id)
+	return err
+}
+
+// ConsumeDownload atomically counts one download of a file against its max_downloads.
+// It returns the new download count, or false when the file has no downloads left.
+func (r *localFileRepository) ConsumeDownload(fileID int64) (int64, bool, error) {
+	query := `UPDATE files SET download_count = download_count + 1
+	          WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)
+	          RETURNING download_count`
+
+	var count int64
+	err := r.db.QueryRow(query, fileID).Scan(&count)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return count, true, nil
+}
+
 // Bucket admin operations
 
 func (r *localFileRepository) AddBucketAdmin(admin *BucketAdmin) error {
@@ -326,6 +710,86 @@ func (r *localFileRepository) GetBucketAdminsByUserID(userID string) ([]*BucketA
 	return admins, nil
 }
 
+// bucketSummarySorts maps the sort keys of a BucketPage to the columns they order by
+var bucketSummarySorts = map[string][]string{
+	BucketSortCreatedAt: {"b.created_at"},
+	BucketSortExpiresAt: {"b.expires_at IS NULL", "b.expires_at"}, // Buckets that never expire sort as the latest
+	BucketSortSize:      {"total_size"},
+	BucketSortFiles:     {"file_count"},
+}
+
+// GetBucketSummariesByUserID lists one page of the unexpired buckets a user administers,
+// with their file count and total size, along with how many such buckets there are in all
+func (r *localFileRepository) GetBucketSummariesByUserID(userID string, page BucketPage, now int64) ([]*BucketSummary, int64, error) {
+	columns, ok := bucketSummarySorts[page.Sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown bucket sort %q", page.Sort)
+	}
+	direction := " ASC"
+	if page.Descending {
+		direction = " DESC"
+	}
+	// The bucket ID breaks ties so pages never overlap
+	orderBy := make([]string, 0, len(columns)+1)
+	for _, column := range append(columns, "b.id") {
+		orderBy = append(orderBy, column+direction)
+	}
+
+	var total int64
+	query := `SELECT COUNT(*)
+	          FROM bucket_admins a JOIN buckets b ON b.id = a.bucket_id
+	          WHERE a.user_id = ? AND (b.expires_at IS NULL OR b.expires_at > ?)`
+	if err := r.db.QueryRow(query, userID, now).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query = `SELECT b.id, b.title, b.password_hash IS NOT NULL, b.owner_id IS a.user_id, b.created_at, b.expires_at,
+	                COUNT(f.id) AS file_count, COALESCE(SUM(f.size), 0) AS total_size
+	         FROM bucket_admins a
+	         JOIN buckets b ON b.id = a.bucket_id
+	         LEFT JOIN files f ON f.bucket_id = b.id
+	         WHERE a.user_id = ? AND (b.expires_at IS NULL OR b.expires_at > ?)
+	         GROUP BY b.id
+	         ORDER BY ` + strings.Join(orderBy, ", ") + `
+	         LIMIT ? OFFSET ?`
+
+	rows, err := r.db.Query(query, userID, now, page.Limit, page.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	summaries := make([]*BucketSummary, 0)
+	for rows.Next() {
+		summary := &BucketSummary{}
+		var title sql.NullString
+		var expiresAt sql.NullInt64
+
+		err := rows.Scan(
+			&summary.BucketID, &title, &summary.Protected, &summary.IsOwner, &summary.CreatedAt, &expiresAt,
+			&summary.FileCount, &summary.TotalSize,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if title.Valid {
+			summary.Title = &title.String
+		}
+		if expiresAt.Valid {
+			summary.ExpiresAt = &expiresAt.Int64
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return summaries, total, nil
+}
+
 func (r *localFileRepository) IsBucketAdmin(userID, bucketID string) (bool, error) {
 	query := `SELECT 1 FROM bucket_admins WHERE user_id = ? AND bucket_id = ? LIMIT 1`
 
@@ -340,3 +804,725 @@ func (r *localFileRepository) IsBucketAdmin(userID, bucketID string) (bool, erro
 
 	return true, nil
 }
+
+// Share link operations
+
+const shareLinkColumns = `id, bucket_id, file_id, label, created_by, created_at, expires_at, max_downloads, download_count`
+
+func (r *localFileRepository) CreateShareLink(link *ShareLink) error {
+	query := `INSERT INTO share_links (` + shareLinkColumns + `)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := r.db.Exec(query,
+		link.ID, link.BucketID, link.FileID, link.Label, link.CreatedBy, link.CreatedAt,
+		link.ExpiresAt, link.MaxDownloads, link.DownloadCount,
+	)
+	return err
+}
+
+func (r *localFileRepository) GetShareLinkByID(id string) (*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE id = ? LIMIT 1`
+
+	link, err := scanShareLink(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return link, nil
+}
+
+func (r *localFileRepository) GetShareLinksByFileID(fileID int64) ([]*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE file_id = ? ORDER BY created_at ASC, id ASC`
+
+	rows, err := r.db.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*ShareLink, 0)
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func (r *localFileRepository) DeleteShareLink(id string) error {
+	query := `DELETE FROM share_links WHERE id = ?`
+
+	_, err := r.db.Exec(query, id)
+	return err
+}
+
+// ConsumeShareLinkDownload counts a download through a link, reporting false once its cap is reached
+func (r *localFileRepository) ConsumeShareLinkDownload(id string) (bool, error) {
+	query := `UPDATE share_links SET download_count = download_count + 1
+	          WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)`
+
+	res, err := r.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func scanShareLink(row interface{ Scan(dest ...any) error }) (*ShareLink, error) {
+	link := &ShareLink{}
+	var label sql.NullString
+	var maxDownloads sql.NullInt64
+
+	err := row.Scan(
+		&link.ID, &link.BucketID, &link.FileID, &label, &link.CreatedBy, &link.CreatedAt,
+		&link.ExpiresAt, &maxDownloads, &link.DownloadCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if label.Valid {
+		link.Label = &label.String
+	}
+	if maxDownloads.Valid {
+		link.MaxDownloads = &maxDownloads.Int64
+	}
+
+	return link, nil
+}
+
+// Bucket token operations
+
+const bucketTokenColumns = `id, bucket_id, user_id, privileges, created_at, expires_at, revoked_at`
+
+func (r *localFileRepository) CreateBucketToken(token *BucketToken) error {
+	query := `INSERT INTO bucket_tokens (` + bucketTokenColumns + `)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := r.db.Exec(query,
+		token.ID, token.BucketID, token.UserID, strings.Join(token.Privileges, ","),
+		token.CreatedAt, token.ExpiresAt, token.RevokedAt,
+	)
+	return err
+}
+
+func (r *localFileRepository) GetBucketToken(id string) (*BucketToken, error) {
+	query := `SELECT ` + bucketTokenColumns + ` FROM bucket_tokens WHERE id = ? LIMIT 1`
+
+	token, err := scanBucketToken(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetActiveBucketTokens lists the unexpired, unrevoked tokens of a bucket, newest first
+func (r *localFileRepository) GetActiveBucketTokens(bucketID string, now int64) ([]*BucketToken, error) {
+	query := `SELECT ` + bucketTokenColumns + ` FROM bucket_tokens
+	          WHERE bucket_id = ? AND revoked_at IS NULL AND expires_at > ?
+	          ORDER BY created_at DESC, id ASC`
+
+	rows, err := r.db.Query(query, bucketID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*BucketToken, 0)
+	for rows.Next() {
+		token, err := scanBucketToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// RevokeBucketToken revokes one token of a bucket, reporting false when there was no such active token
+func (r *localFileRepository) RevokeBucketToken(bucketID, id string, now int64) (bool, error) {
+	query := `UPDATE bucket_tokens SET revoked_at = ?
+	          WHERE id = ? AND bucket_id = ? AND revoked_at IS NULL AND expires_at > ?`
+
+	res, err := r.db.Exec(query, now, id, bucketID, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// RevokeBucketTokens revokes every active token of a bucket and returns how many there were
+func (r *localFileRepository) RevokeBucketTokens(bucketID string, now int64) (int64, error) {
+	query := `UPDATE bucket_tokens SET revoked_at = ?
+	          WHERE bucket_id = ? AND revoked_at IS NULL AND expires_at > ?`
+
+	res, err := r.db.Exec(query, now, bucketID, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteExpiredBucketTokens drops the records of tokens that no longer validate anyway
+func (r *localFileRepository) DeleteExpiredBucketTokens(now int64) (int64, error) {
+	query := `DELETE FROM bucket_tokens WHERE expires_at <= ?`
+
+	res, err := r.db.Exec(query, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanBucketToken(row interface{ Scan(dest ...any) error }) (*BucketToken, error) {
+	token := &BucketToken{}
+	var userID sql.NullString
+	var privileges string
+	var revokedAt sql.NullInt64
+
+	err := row.Scan(
+		&token.ID, &token.BucketID, &userID, &privileges, &token.CreatedAt, &token.ExpiresAt, &revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID.Valid {
+		token.UserID = &userID.String
+	}
+	if privileges != "" {
+		token.Privileges = strings.Split(privileges, ",")
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Int64
+	}
+
+	return token, nil
+}
+
+// Failed password attempt operations
+
+func (r *localFileRepository) GetAuthFailure(scope, key string) (*AuthFailure, error) {
+	query := `SELECT scope, key, failures, last_failure_at, locked_until
+	          FROM auth_failures WHERE scope = ? AND key = ? LIMIT 1`
+
+	failure := &AuthFailure{}
+	var lockedUntil sql.NullInt64
+
+	err := r.db.QueryRow(query, scope, key).Scan(
+		&failure.Scope, &failure.Key, &failure.Failures, &failure.LastFailureAt, &lockedUntil,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if lockedUntil.Valid {
+		failure.LockedUntil = &lockedUntil.Int64
+	}
+
+	return failure, nil
+}
+
+// RecordAuthFailure counts a failed attempt and returns the consecutive failures so far.
+// The count starts over when the previous failure happened before windowStart.
+func (r *localFileRepository) RecordAuthFailure(scope, key string, now, windowStart int64) (int64, error) {
+	query := `INSERT INTO auth_failures (scope, key, failures, last_failure_at)
+	          VALUES (?, ?, 1, ?)
+	          ON CONFLICT (scope, key) DO UPDATE SET
+	              failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+	              last_failure_at = excluded.last_failure_at
+	          RETURNING failures`
+
+	var failures int64
+	err := r.db.QueryRow(query, scope, key, now, windowStart).Scan(&failures)
+	return failures, err
+}
+
+func (r *localFileRepository) LockAuthFailure(scope, key string, lockedUntil int64) error {
+	query := `UPDATE auth_failures SET locked_until = ? WHERE scope = ? AND key = ?`
+
+	_, err := r.db.Exec(query, lockedUntil, scope, key)
+	return err
+}
+
+func (r *localFileRepository) ClearAuthFailure(scope, key string) error {
+	query := `DELETE FROM auth_failures WHERE scope = ? AND key = ?`
+
+	_, err := r.db.Exec(query, scope, key)
+	return err
+}
+
+// DeleteStaleAuthFailures drops counters whose last failure is out of the window and that no longer lock anything
+func (r *localFileRepository) DeleteStaleAuthFailures(windowStart, now int64) (int64, error) {
+	query := `DELETE FROM auth_failures
+	          WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until <= ?)`
+
+	res, err := r.db.Exec(query, windowStart, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (r *localFileRepository) CreateBucketLockout(lockout *BucketLockout) error {
+	query := `INSERT INTO bucket_lockouts (bucket_id, scope, client_ip, failures, locked_until, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?)`
+
+	res, err := r.db.Exec(query,
+		lockout.BucketID, lockout.Scope, lockout.ClientIP, lockout.Failures, lockout.LockedUntil, lockout.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	lockout.ID = id
+
+	return nil
+}
+
+// GetBucketLockouts returns the most recent lockouts of a bucket, newest first
+func (r *localFileRepository) GetBucketLockouts(bucketID string, limit int) ([]*BucketLockout, error) {
+	query := `SELECT id, bucket_id, scope, client_ip, failures, locked_until, created_at
+	          FROM bucket_lockouts WHERE bucket_id = ? ORDER BY created_at DESC, id DESC LIMIT ?`
+
+	rows, err := r.db.Query(query, bucketID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := make([]*BucketLockout, 0)
+	for rows.Next() {
+		lockout := &BucketLockout{}
+		err := rows.Scan(
+			&lockout.ID, &lockout.BucketID, &lockout.Scope, &lockout.ClientIP,
+			&lockout.Failures, &lockout.LockedUntil, &lockout.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
+
+// Blob operations
+
+const blobColumns = `sha256, s3_key, size, ref_count, created_at`
+
+// AcquireBlob takes a reference to the blob holding blob.SHA256, inserting blob when the content
+// is new. It returns the stored blob, whose S3Key differs from blob.S3Key when the content already existed.
+func (r *localFileRepository) AcquireBlob(blob *Blob) (*Blob, error) {
+	query := `INSERT INTO blobs (` + blobColumns + `) VALUES (?, ?, ?, 1, ?)
+	          ON CONFLICT(sha256) DO UPDATE SET ref_count = ref_count + 1
+	          RETURNING ` + blobColumns
+
+	stored := &Blob{}
+	err := r.db.QueryRow(query, blob.SHA256, blob.S3Key, blob.Size, blob.CreatedAt).Scan(
+		&stored.SHA256, &stored.S3Key, &stored.Size, &stored.RefCount, &stored.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// ReferenceBlob takes a reference to an existing blob, returning nil when no blob holds the content
+func (r *localFileRepository) ReferenceBlob(sha256 string) (*Blob, error) {
+	query := `UPDATE blobs SET ref_count = ref_count + 1 WHERE sha256 = ? RETURNING ` + blobColumns
+
+	blob := &Blob{}
+	err := r.db.QueryRow(query, sha256).Scan(
+		&blob.SHA256, &blob.S3Key, &blob.Size, &blob.RefCount, &blob.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// ReleaseBlob gives back a reference that never made it into a files row.
+// References held by files rows are released by a trigger when the row is deleted.
+func (r *localFileRepository) ReleaseBlob(s3Key string) error {
+	query := `UPDATE blobs SET ref_count = ref_count - 1 WHERE s3_key = ?`
+
+	_, err := r.db.Exec(query, s3Key)
+	return err
+}
+
+// DeleteUnreferencedBlobs removes the rows of blobs nothing references any more and returns them so their
+// objects can be deleted. The row goes before the object, so no new reference can reach a deleted object.
+func (r *localFileRepository) DeleteUnreferencedBlobs() ([]*Blob, error) {
+	query := `DELETE FROM blobs WHERE ref_count <= 0 RETURNING ` + blobColumns
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make([]*Blob, 0)
+	for rows.Next() {
+		blob := &Blob{}
+		if err := rows.Scan(&blob.SHA256, &blob.S3Key, &blob.Size, &blob.RefCount, &blob.CreatedAt); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// Upload session operations
+
+// CreateUploadSession stores a session and its declared files in one transaction
+func (r *localFileRepository) CreateUploadSession(session *UploadSession, files []*PendingFile) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO upload_sessions (bucket_id, token_hash, owner_id, expires_at, created_at)
+	          VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query,
+		session.BucketID, session.TokenHash, session.OwnerID, session.ExpiresAt, session.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO pending_files (string_id, bucket_id, original_name, size, content_type, sha256, s3_key, max_downloads, created_at)
+	         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, file := range files {
+		if _, err := tx.Exec(query,
+			file.StringID, file.BucketID, file.OriginalName, file.Size,
+			file.ContentType, file.SHA256, file.S3Key, file.MaxDownloads, file.CreatedAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *localFileRepository) GetUploadSession(bucketID string) (*UploadSession, error) {
+	query := `SELECT bucket_id, token_hash, owner_id, expires_at, created_at
+	          FROM upload_sessions WHERE bucket_id = ? LIMIT 1`
+
+	session := &UploadSession{}
+	var ownerID sql.NullString
+
+	err := r.db.QueryRow(query, bucketID).Scan(
+		&session.BucketID, &session.TokenHash, &ownerID, &session.ExpiresAt, &session.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if ownerID.Valid {
+		session.OwnerID = &ownerID.String
+	}
+
+	return session, nil
+}
+
+func (r *localFileRepository) GetExpiredUploadSessions(now int64) ([]*UploadSession, error) {
+	query := `SELECT bucket_id, token_hash, owner_id, expires_at, created_at
+	          FROM upload_sessions WHERE expires_at <= ? ORDER BY expires_at ASC`
+
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*UploadSession, 0)
+	for rows.Next() {
+		session := &UploadSession{}
+		var ownerID sql.NullString
+
+		err := rows.Scan(
+			&session.BucketID, &session.TokenHash, &ownerID, &session.ExpiresAt, &session.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if ownerID.Valid {
+			session.OwnerID = &ownerID.String
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteUploadSession removes a session; its pending_files rows cascade
+func (r *localFileRepository) DeleteUploadSession(bucketID string) error {
+	query := `DELETE FROM upload_sessions WHERE bucket_id = ?`
+
+	_, err := r.db.Exec(query, bucketID)
+	return err
+}
+
+func (r *localFileRepository) GetPendingFilesByBucketID(bucketID string) ([]*PendingFile, error) {
+	query := `SELECT string_id, bucket_id, original_name, size, content_type, sha256, s3_key, max_downloads, created_at
+	          FROM pending_files WHERE bucket_id = ? ORDER BY created_at ASC, rowid ASC`
+
+	rows, err := r.db.Query(query, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*PendingFile, 0)
+	for rows.Next() {
+		file := &PendingFile{}
+		var maxDownloads sql.NullInt64
+
+		err := rows.Scan(
+			&file.StringID, &file.BucketID, &file.OriginalName, &file.Size,
+			&file.ContentType, &file.SHA256, &file.S3Key, &maxDownloads, &file.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if maxDownloads.Valid {
+			file.MaxDownloads = &maxDownloads.Int64
+		}
+
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Tus upload operations
+
+const tusUploadColumns = `id, upload_length, upload_offset, metadata, file_name, content_type, bucket_id, owner_id, client_ip,
+	          password_hash, bucket_expires_at, max_downloads, burn_after_reading, bucket_title, bucket_description, bucket_labels,
+	          string_id, created_at, updated_at, expires_at`
+
+func (r *localFileRepository) CreateTusUpload(upload *TusUpload) error {
+	labels, err := encodeLabels(upload.BucketLabels)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO tus_uploads (` + tusUploadColumns + `)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = r.db.Exec(query,
+		upload.ID, upload.Length, upload.Offset, upload.Metadata, upload.FileName, upload.ContentType,
+		upload.BucketID, upload.OwnerID, upload.ClientIP, upload.PasswordHash, upload.BucketExpiresAt, upload.MaxDownloads,
+		upload.BurnAfterReading, upload.BucketTitle, upload.BucketDescription, labels,
+		upload.StringID, upload.CreatedAt, upload.UpdatedAt, upload.ExpiresAt,
+	)
+	return err
+}
+
+func (r *localFileRepository) GetTusUpload(id string) (*TusUpload, error) {
+	query := `SELECT ` + tusUploadColumns + ` FROM tus_uploads WHERE id = ? LIMIT 1`
+
+	upload, err := scanTusUpload(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// UpdateTusUpload saves the progress of an upload: its offset, resulting bucket and file, and expiry
+func (r *localFileRepository) UpdateTusUpload(upload *TusUpload) error {
+	query := `UPDATE tus_uploads SET upload_offset = ?, bucket_id = ?, string_id = ?, updated_at = ?, expires_at = ?
+	          WHERE id = ?`
+
+	_, err := r.db.Exec(query,
+		upload.Offset, upload.BucketID, upload.StringID, upload.UpdatedAt, upload.ExpiresAt, upload.ID,
+	)
+	return err
+}
+
+func (r *localFileRepository) DeleteTusUpload(id string) error {
+	query := `DELETE FROM tus_uploads WHERE id = ?`
+
+	_, err := r.db.Exec(query, id)
+	return err
+}
+
+func (r *localFileRepository) GetExpiredTusUploads(now int64) ([]*TusUpload, error) {
+	query := `SELECT ` + tusUploadColumns + ` FROM tus_uploads WHERE expires_at <= ? ORDER BY expires_at ASC`
+
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*TusUpload, 0)
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
+
+// GetTusStagingBytes totals the declared length of the tus uploads not yet stored as files,
+// whose bytes are staged on local disk
+func (r *localFileRepository) GetTusStagingBytes() (int64, error) {
+	var staged int64
+	query := `SELECT COALESCE(SUM(upload_length), 0) FROM tus_uploads WHERE string_id IS NULL`
+	if err := r.db.QueryRow(query).Scan(&staged); err != nil {
+		return 0, err
+	}
+	return staged, nil
+}
+
+// scanTusUpload reads a row selected with tusUploadColumns
+func scanTusUpload(row interface{ Scan(dest ...any) error }) (*TusUpload, error) {
+	upload := &TusUpload{}
+	var bucketID, ownerID, clientIP, passwordHash, bucketTitle, bucketDescription, bucketLabels, stringID sql.NullString
+	var bucketExpiresAt, maxDownloads sql.NullInt64
+
+	err := row.Scan(
+		&upload.ID, &upload.Length, &upload.Offset, &upload.Metadata, &upload.FileName, &upload.ContentType,
+		&bucketID, &ownerID, &clientIP, &passwordHash, &bucketExpiresAt, &maxDownloads,
+		&upload.BurnAfterReading, &bucketTitle, &bucketDescription, &bucketLabels,
+		&stringID, &upload.CreatedAt, &upload.UpdatedAt, &upload.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if bucketID.Valid {
+		upload.BucketID = &bucketID.String
+	}
+	if ownerID.Valid {
+		upload.OwnerID = &ownerID.String
+	}
+	if clientIP.Valid {
+		upload.ClientIP = &clientIP.String
+	}
+	if passwordHash.Valid {
+		upload.PasswordHash = &passwordHash.String
+	}
+	if bucketExpiresAt.Valid {
+		upload.BucketExpiresAt = &bucketExpiresAt.Int64
+	}
+	if bucketTitle.Valid {
+		upload.BucketTitle = &bucketTitle.String
+	}
+	if bucketDescription.Valid {
+		upload.BucketDescription = &bucketDescription.String
+	}
+	if upload.BucketLabels, err = decodeLabels(bucketLabels); err != nil {
+		return nil, err
+	}
+	if maxDownloads.Valid {
+		upload.MaxDownloads = &maxDownloads.Int64
+	}
+	if stringID.Valid {
+		upload.StringID = &stringID.String
+	}
+
+	return upload, nil
+}
+
+// encodeLabels stores labels as a JSON array, or NULL when there are none
+func encodeLabels(labels []string) (*string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	text := string(encoded)
+	return &text, nil
+}
+
+func decodeLabels(value sql.NullString) ([]string, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+	var labels []string
+	if err := json.Unmarshal([]byte(value.String), &labels); err != nil {
+		return nil, fmt.Errorf("invalid labels %q: %w", value.String, err)
+	}
+	return labels, nil
+}
@@ -0,0 +1,75 @@
+package local
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// columnMigration describes a column added to a table after it was first created.
+// schema.sql declares the column for new databases; existing databases get it through ALTER TABLE.
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+	backfill   string // Optional statement filling in the column for existing rows, run only when it is added
+}
+
+// migrateColumns adds any missing columns to tables that already exist.
+// It must run before the schema so indexes on new columns can be created.
+func migrateColumns(db *sql.DB, migrations []columnMigration) error {
+	for _, m := range migrations {
+		columns, err := tableColumns(db, m.table)
+		if err != nil {
+			return err
+		}
+
+		// Table does not exist yet, schema.sql creates it with the column
+		if len(columns) == 0 {
+			continue
+		}
+		if columns[m.column] {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+		if m.backfill != "" {
+			if _, err := db.Exec(m.backfill); err != nil {
+				return fmt.Errorf("failed to backfill column %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
@@ -5,11 +5,22 @@ PRAGMA foreign_keys = ON;
 CREATE TABLE IF NOT EXISTS buckets (
     id TEXT PRIMARY KEY,  -- storage_id/session_id (e.g., "samplebuck", 10-char alphanumeric)
     password_hash TEXT,  -- NULL = public/anonymous access, set = protected (hashing logic deferred)
+    password_version INTEGER NOT NULL DEFAULT 0,  -- Bumped on every password change; access tokens for older versions are rejected
     created_at INTEGER NOT NULL,  -- Unix timestamp
-    updated_at INTEGER NOT NULL
+    updated_at INTEGER NOT NULL,
+    expires_at INTEGER,  -- NULL = never expires, Unix timestamp after which the reaper deletes the bucket
+    max_downloads INTEGER,  -- Download limit each file starts with, files added later included; not a bucket-wide total. NULL = unlimited
+    burn_after_reading INTEGER NOT NULL DEFAULT 0,  -- 1 = delete a file once its last allowed download finishes
+    uploader_ip TEXT,  -- Client IP of an anonymous uploader, charged for the bucket's quota; NULL for logged-in uploads
+    owner_id TEXT,  -- Admin who owns the bucket (no FK constraint - cross-db), NULL for anonymous buckets
+    title TEXT,  -- Shown to recipients instead of the bucket ID, NULL = none
+    description TEXT,  -- Markdown shown to recipients, NULL = none
+    labels TEXT  -- JSON array of free-form labels, NULL = none
 );
 
 CREATE INDEX IF NOT EXISTS idx_buckets_created_at ON buckets(created_at);
+CREATE INDEX IF NOT EXISTS idx_buckets_expires_at ON buckets(expires_at);
+CREATE INDEX IF NOT EXISTS idx_buckets_uploader_ip ON buckets(uploader_ip);
 
 -- Files table: File metadata and references
 CREATE TABLE IF NOT EXISTS files (
@@ -17,11 +28,17 @@ CREATE TABLE IF NOT EXISTS files (
     string_id TEXT NOT NULL UNIQUE,  -- Surrogate key stored in DB, used in S3 path (e.g., "hashid1")
     bucket_id TEXT NOT NULL REFERENCES buckets(id) ON DELETE CASCADE,
     original_name TEXT NOT NULL,  -- Original filename (e.g., "test.txt")
+    path TEXT NOT NULL DEFAULT '',  -- Folder of the file within the bucket (e.g., "docs/img"), '' for the top level
     owner_id TEXT,  -- Nullable owner reference to users table in auth database (no FK constraint - cross-db)
     size INTEGER NOT NULL,  -- File size in bytes
-    content_type TEXT NOT NULL,  -- MIME type
+    content_type TEXT NOT NULL,  -- MIME type detected from the content
     s3_key TEXT NOT NULL,  -- Full S3 key (e.g., "samplebuck/hashid1")
-    created_at INTEGER NOT NULL  -- Unix timestamp
+    created_at INTEGER NOT NULL,  -- Unix timestamp
+    max_downloads INTEGER,  -- Download limit, NULL = unlimited
+    download_count INTEGER NOT NULL DEFAULT 0,  -- Downloads counted so far
+    sha256 TEXT,  -- Hex SHA-256 of the content, NULL when it was not computed (e.g. direct-to-S3 uploads)
+    declared_content_type TEXT,  -- Content-Type sent by the client, NULL when none
+    content_type_mismatch INTEGER NOT NULL DEFAULT 0  -- 1 when the declared type or the extension disagrees with the content
 );
 
 CREATE INDEX IF NOT EXISTS idx_files_bucket_id ON files(bucket_id);
@@ -40,3 +57,126 @@ CREATE TABLE IF NOT EXISTS bucket_admins (
 CREATE INDEX IF NOT EXISTS idx_bucket_admins_user_id ON bucket_admins(user_id);
 CREATE INDEX IF NOT EXISTS idx_bucket_admins_bucket_id ON bucket_admins(bucket_id);
 
+-- Share links table: Signed links that download one file without the bucket password
+CREATE TABLE IF NOT EXISTS share_links (
+    id TEXT PRIMARY KEY,  -- Random link ID, signed into the link token
+    bucket_id TEXT NOT NULL REFERENCES buckets(id) ON DELETE CASCADE,
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    label TEXT,  -- Note for the admins, e.g. who the link was sent to
+    created_by TEXT NOT NULL,  -- Admin who created the link (no FK constraint - cross-db)
+    created_at INTEGER NOT NULL,  -- Unix timestamp
+    expires_at INTEGER NOT NULL,  -- Unix timestamp after which the link stops working
+    max_downloads INTEGER,  -- Downloads allowed through the link, NULL = unlimited
+    download_count INTEGER NOT NULL DEFAULT 0  -- Downloads through the link so far
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_file_id ON share_links(file_id);
+
+-- Bucket tokens table: X-Bucket-Access tokens issued per bucket, so they can be revoked before they expire
+CREATE TABLE IF NOT EXISTS bucket_tokens (
+    id TEXT PRIMARY KEY,  -- jti of the token
+    bucket_id TEXT NOT NULL REFERENCES buckets(id) ON DELETE CASCADE,
+    user_id TEXT,  -- User the token was issued to, NULL for anonymous or minted tokens (no FK constraint - cross-db)
+    privileges TEXT NOT NULL,  -- Comma-separated privileges the token grants
+    created_at INTEGER NOT NULL,  -- Unix timestamp
+    expires_at INTEGER NOT NULL,  -- Unix timestamp the token expires at
+    revoked_at INTEGER  -- NULL = not revoked
+);
+
+CREATE INDEX IF NOT EXISTS idx_bucket_tokens_bucket_id ON bucket_tokens(bucket_id);
+CREATE INDEX IF NOT EXISTS idx_bucket_tokens_expires_at ON bucket_tokens(expires_at);
+
+-- Auth failures table: Failed bucket password attempts per bucket and per client IP
+CREATE TABLE IF NOT EXISTS auth_failures (
+    scope TEXT NOT NULL,  -- "bucket" or "ip"
+    key TEXT NOT NULL,  -- Bucket ID or client IP
+    failures INTEGER NOT NULL,  -- Consecutive failures within the tracking window
+    last_failure_at INTEGER NOT NULL,  -- Unix timestamp
+    locked_until INTEGER,  -- Unix timestamp before which attempts are refused, NULL = not locked
+    PRIMARY KEY (scope, key)
+);
+
+-- Bucket lockouts table: Lockouts caused by failed password attempts, shown to the bucket's admins
+CREATE TABLE IF NOT EXISTS bucket_lockouts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    bucket_id TEXT NOT NULL REFERENCES buckets(id) ON DELETE CASCADE,
+    scope TEXT NOT NULL,  -- "bucket" when the bucket was locked, "ip" when the client IP was
+    client_ip TEXT NOT NULL,  -- Client IP of the attempt that caused the lockout
+    failures INTEGER NOT NULL,  -- Consecutive failures that led to it
+    locked_until INTEGER NOT NULL,  -- Unix timestamp
+    created_at INTEGER NOT NULL  -- Unix timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_bucket_lockouts_bucket_id ON bucket_lockouts(bucket_id, created_at);
+
+CREATE INDEX IF NOT EXISTS idx_buckets_owner_id ON buckets(owner_id);
+
+-- Upload sessions table: Pending direct-to-S3 uploads awaiting their finalize step
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    bucket_id TEXT PRIMARY KEY REFERENCES buckets(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL,  -- SHA-256 of the upload token handed to the client
+    owner_id TEXT,  -- Nullable uploader reference to users table in auth database (no FK constraint - cross-db)
+    expires_at INTEGER NOT NULL,  -- Unix timestamp after which the session can no longer be completed
+    created_at INTEGER NOT NULL  -- Unix timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+
+-- Pending files table: Files declared in an upload session that have no files row yet
+CREATE TABLE IF NOT EXISTS pending_files (
+    string_id TEXT PRIMARY KEY,  -- Surrogate key reserved for the file, used in S3 path
+    bucket_id TEXT NOT NULL REFERENCES upload_sessions(bucket_id) ON DELETE CASCADE,
+    original_name TEXT NOT NULL,  -- Filename as sent, with any relative folder path (e.g., "docs/test.txt")
+    size INTEGER NOT NULL,  -- Declared file size in bytes
+    content_type TEXT NOT NULL,  -- Declared MIME type
+    sha256 TEXT NOT NULL DEFAULT '',  -- Declared hex SHA-256, signed into the presigned URL so S3 checks the upload against it
+    s3_key TEXT NOT NULL,  -- Full S3 key the presigned URL writes to
+    max_downloads INTEGER,  -- Download limit, NULL = unlimited
+    created_at INTEGER NOT NULL  -- Unix timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_files_bucket_id ON pending_files(bucket_id);
+
+-- Tus uploads table: Resumable uploads (tus 1.0) whose bytes are staged on disk until complete
+CREATE TABLE IF NOT EXISTS tus_uploads (
+    id TEXT PRIMARY KEY,  -- Upload ID used in the tus upload URL
+    upload_length INTEGER NOT NULL,  -- Total size in bytes declared with Upload-Length
+    upload_offset INTEGER NOT NULL DEFAULT 0,  -- Bytes received and staged so far
+    metadata TEXT NOT NULL,  -- Upload-Metadata echoed back on HEAD, without secrets
+    file_name TEXT NOT NULL,  -- Original filename (e.g., "test.txt")
+    content_type TEXT NOT NULL,  -- Declared MIME type
+    bucket_id TEXT,  -- Existing bucket to add the file to, or the bucket created once complete
+    owner_id TEXT,  -- Nullable uploader reference to users table in auth database (no FK constraint - cross-db)
+    client_ip TEXT,  -- Client IP of an anonymous uploader, recorded on the bucket created once complete
+    password_hash TEXT,  -- Password of the bucket created once complete
+    bucket_expires_at INTEGER,  -- Expiry of the bucket created once complete
+    max_downloads INTEGER,  -- Download limit of the finished file, NULL = bucket default
+    burn_after_reading INTEGER NOT NULL DEFAULT 0,  -- Setting of the bucket created once complete
+    bucket_title TEXT,  -- Title of the bucket created once complete
+    bucket_description TEXT,  -- Description of the bucket created once complete
+    bucket_labels TEXT,  -- JSON array of labels of the bucket created once complete
+    string_id TEXT,  -- Set once the upload is complete and stored as a file
+    created_at INTEGER NOT NULL,  -- Unix timestamp
+    updated_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL  -- Unix timestamp after which the reaper discards the upload
+);
+
+CREATE INDEX IF NOT EXISTS idx_tus_uploads_expires_at ON tus_uploads(expires_at);
+
+-- Blobs table: Deduplicated S3 objects shared by every file with the same content
+CREATE TABLE IF NOT EXISTS blobs (
+    sha256 TEXT PRIMARY KEY,  -- Hex SHA-256 of the content
+    s3_key TEXT NOT NULL UNIQUE,  -- Full S3 key of the shared object (e.g., "blobs/<uuid>")
+    size INTEGER NOT NULL,  -- Object size in bytes
+    ref_count INTEGER NOT NULL,  -- files rows (and in-flight uploads) referencing the object
+    created_at INTEGER NOT NULL  -- Unix timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_blobs_ref_count ON blobs(ref_count);
+
+-- Removing a file, directly or through its bucket's cascade, gives back its blob reference.
+-- Blobs left without references are deleted by the file service, row first, then the object.
+CREATE TRIGGER IF NOT EXISTS trg_files_release_blob AFTER DELETE ON files
+BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE s3_key = OLD.s3_key;
+END;
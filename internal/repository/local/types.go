@@ -37,28 +37,184 @@ type OAuthSession struct {
 
 // Bucket represents a storage container for files
 type Bucket struct {
-	ID           string  // storage_id/session_id (e.g., "samplebuck")
-	PasswordHash *string // NULL = public/anonymous, set = protected
-	CreatedAt    int64
-	UpdatedAt    int64
+	ID                  string  // storage_id/session_id (e.g., "samplebuck")
+	PasswordHash        *string // NULL = public/anonymous, set = protected
+	PasswordVersion     int64   // Bumped on every password change
+	CreatedAt           int64
+	UpdatedAt           int64
+	ExpiresAt           *int64  // NULL = never expires
+	DefaultMaxDownloads *int64  // Download limit each file starts with, files added later too; not a bucket-wide total. NULL = unlimited
+	BurnAfterReading    bool    // Delete a file once its last allowed download finishes
+	UploaderIP          *string // Client IP of an anonymous uploader, NULL for logged-in uploads
+	OwnerID             *string // Admin who owns the bucket, NULL for anonymous buckets
+	Title               *string // Shown to recipients instead of the ID
+	Description         *string // Markdown shown to recipients
+	Labels              []string
+}
+
+// Usage totals what one uploader stores
+type Usage struct {
+	Files   int64
+	Bytes   int64 // Sum of file sizes, before deduplication, and of the sizes open uploads declared
+	Buckets int64
 }
 
 // File represents file metadata
 type File struct {
-	ID           int64   // Numeric primary key
-	StringID     string  // Surrogate key used in S3 path (e.g., "hashid1")
-	BucketID     string  // References buckets(id)
-	OriginalName string  // Original filename (e.g., "test.txt")
-	OwnerID      *string // Nullable owner reference to users(id)
-	Size         int64   // File size in bytes
-	ContentType  string  // MIME type
-	S3Key        string  // Full S3 key (e.g., "samplebuck/hashid1")
+	ID            int64   // Numeric primary key
+	StringID      string  // Surrogate key used in S3 path (e.g., "hashid1")
+	BucketID      string  // References buckets(id)
+	OriginalName  string  // Original filename (e.g., "test.txt")
+	Path          string  // Folder of the file within the bucket (e.g., "docs/img"), "" for the top level
+	OwnerID       *string // Nullable owner reference to users(id)
+	Size          int64   // File size in bytes
+	ContentType   string  // MIME type detected from the content
+	S3Key         string  // Full S3 key (e.g., "samplebuck/hashid1")
+	CreatedAt     int64
+	MaxDownloads  *int64  // Download limit, NULL = unlimited
+	DownloadCount int64   // Downloads counted so far
+	SHA256        *string // Hex SHA-256 of the content, NULL when unknown
+
+	DeclaredContentType *string // Content-Type sent by the client, NULL when none
+	ContentTypeMismatch bool    // The declared type or the extension disagrees with the content
+}
+
+// Blob represents a deduplicated S3 object shared by every file with the same content
+type Blob struct {
+	SHA256    string // Hex SHA-256 of the content
+	S3Key     string // Full S3 key (e.g., "blobs/<uuid>")
+	Size      int64
+	RefCount  int64 // Files referencing the object
+	CreatedAt int64
+}
+
+// UploadSession represents a pending direct-to-S3 upload into a bucket
+type UploadSession struct {
+	BucketID  string  // References buckets(id)
+	TokenHash string  // SHA-256 of the upload token
+	OwnerID   *string // Nullable uploader reference to users(id)
+	ExpiresAt int64
+	CreatedAt int64
+}
+
+// PendingFile represents a file declared in an upload session but not yet finalized
+type PendingFile struct {
+	StringID     string // Surrogate key reserved for the file
+	BucketID     string // References upload_sessions(bucket_id)
+	OriginalName string
+	Size         int64  // Declared size in bytes
+	ContentType  string // Declared MIME type
+	SHA256       string // Declared hex SHA-256, "" for sessions started before it was required
+	S3Key        string
+	MaxDownloads *int64 // Download limit, NULL = unlimited
 	CreatedAt    int64
 }
 
+// TusUpload represents a resumable upload whose bytes are staged on disk until complete
+type TusUpload struct {
+	ID                string
+	Length            int64 // Declared total size in bytes
+	Offset            int64 // Bytes received so far
+	Metadata          string
+	FileName          string
+	ContentType       string
+	BucketID          *string // Target bucket, NULL = create one when complete
+	OwnerID           *string
+	ClientIP          *string // Anonymous uploader, charged for the bucket created once complete
+	PasswordHash      *string
+	BucketExpiresAt   *int64
+	MaxDownloads      *int64
+	BurnAfterReading  bool
+	BucketTitle       *string
+	BucketDescription *string
+	BucketLabels      []string
+	StringID          *string // Set once the upload is stored as a file
+	CreatedAt         int64
+	UpdatedAt         int64
+	ExpiresAt         int64
+}
+
 // BucketAdmin represents a many-to-many relationship between users and buckets
 type BucketAdmin struct {
 	UserID    string
 	BucketID  string
 	CreatedAt int64
 }
+
+// ShareLink represents a signed link to download one file without the bucket password
+type ShareLink struct {
+	ID            string // Random link ID, signed into the link token
+	BucketID      string // References buckets(id)
+	FileID        int64  // References files(id)
+	Label         *string
+	CreatedBy     string // Admin who created the link
+	CreatedAt     int64
+	ExpiresAt     int64
+	MaxDownloads  *int64 // NULL = unlimited
+	DownloadCount int64
+}
+
+// BucketToken records an issued bucket access token
+type BucketToken struct {
+	ID         string  // jti of the token
+	BucketID   string  // References buckets(id)
+	UserID     *string // User the token was issued to, NULL for anonymous or minted tokens
+	Privileges []string
+	CreatedAt  int64
+	ExpiresAt  int64
+	RevokedAt  *int64 // NULL = not revoked
+}
+
+// Scopes of failed password attempt tracking
+const (
+	AuthScopeBucket = "bucket"
+	AuthScopeIP     = "ip"
+)
+
+// AuthFailure tracks consecutive failed password attempts against one bucket or from one client IP
+type AuthFailure struct {
+	Scope         string // AuthScopeBucket or AuthScopeIP
+	Key           string // Bucket ID or client IP
+	Failures      int64
+	LastFailureAt int64
+	LockedUntil   *int64 // NULL = not locked
+}
+
+// BucketLockout records a lockout caused by failed password attempts on a bucket
+type BucketLockout struct {
+	ID          int64
+	BucketID    string
+	Scope       string // AuthScopeBucket or AuthScopeIP
+	ClientIP    string
+	Failures    int64
+	LockedUntil int64
+	CreatedAt   int64
+}
+
+// Sort keys accepted by BucketPage
+const (
+	BucketSortCreatedAt = "created_at"
+	BucketSortExpiresAt = "expires_at"
+	BucketSortSize      = "size"
+	BucketSortFiles     = "files"
+)
+
+// BucketPage selects one page of a bucket listing
+type BucketPage struct {
+	Sort       string // One of the BucketSort keys
+	Descending bool
+	Limit      int
+	Offset     int
+}
+
+// BucketSummary represents a bucket with totals over its files
+type BucketSummary struct {
+	BucketID  string
+	Title     *string
+	Protected bool // Has a password
+	IsOwner   bool // The listing user owns the bucket rather than only administering it
+	CreatedAt int64
+	ExpiresAt *int64 // NULL = never expires
+	FileCount int64
+	TotalSize int64 // Sum of file sizes in bytes
+}
@@ -8,12 +8,59 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// StreamedRoutes are the routes whose handlers stream the request body to storage instead of reading
+// it whole, so middleware.BodyLimit leaves them alone; every other route keeps the body limit
+var StreamedRoutes = []middleware.StreamedRoute{
+	{Method: fiber.MethodPost, Path: "/files/upload"},
+	{Method: fiber.MethodPost, Path: "/files/s/:id/upload"},
+	{Method: fiber.MethodPut, Path: "/files/s/:id/d/:filename"},
+	{Method: fiber.MethodPatch, Path: "/files/tus/:uploadId"},
+}
+
 func FileRouter(app fiber.Router, fileService file.FileService, authService auth.AuthService) {
 	// Upload route with optional auth middleware
 	app.Post("/files/upload", middleware.OptionalJWTAuth(authService), handlers.FileUpload(fileService))
+	app.Post("/files/uploads", middleware.OptionalJWTAuth(authService), handlers.InitiateUpload(fileService))
+	app.Post("/files/uploads/:id/complete", handlers.CompleteUpload(fileService))
+
+	// Resumable uploads: tus 1.0 core with the creation, termination and checksum extensions
+	tus := app.Group("/files/tus", middleware.TusResumable())
+	tus.Options("/", handlers.TusOptions())
+	tus.Post("/", middleware.OptionalJWTAuth(authService), middleware.TusBucketAuth(fileService, authService), handlers.TusCreate(fileService))
+	tus.Head("/:uploadId", handlers.TusHead(fileService))
+	tus.Patch("/:uploadId", handlers.TusPatch(fileService))
+	tus.Delete("/:uploadId", handlers.TusDelete(fileService))
+
+	// Bucket routes declare the privilege their X-Bucket-Access token must grant on a protected bucket.
+	// /authenticate and /protected are how a client gets a token, so they declare none.
+	// Write and delete routes take a token granting the privilege in place of a login as bucket admin.
+	app.Post("/files/s/:id/upload", middleware.OptionalJWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeWrite), handlers.AddFiles(fileService))
 	app.Post("/files/s/:id/authenticate", middleware.OptionalJWTAuth(authService), handlers.AuthenticateBucket(fileService))
-	app.Get("/files/s/:id", middleware.BucketPasswordAuth(fileService, authService), handlers.RetrieveFileBucket(fileService))
-	app.Get("/files/s/:id/admins", middleware.BucketPasswordAuth(fileService, authService), handlers.GetBucketAdmins(fileService))
+	app.Get("/files/s/:id", middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeRead), handlers.RetrieveFileBucket(fileService))
+	app.Patch("/files/s/:id", middleware.OptionalJWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeWrite), handlers.UpdateBucketDetails(fileService))
+	app.Get("/files/s/:id/admins", middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeRead), handlers.GetBucketAdmins(fileService))
+	app.Post("/files/s/:id/admins", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.AddBucketAdmin(fileService))
+	app.Delete("/files/s/:id/admins/:userId", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.RemoveBucketAdmin(fileService))
+	app.Put("/files/s/:id/owner", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.TransferBucketOwnership(fileService))
 	app.Get("/files/s/:id/protected", handlers.IsProtected(fileService))
-	app.Get("/files/s/:id/d/:filename", middleware.BucketPasswordAuth(fileService, authService), handlers.DownloadFile(fileService))
+	app.Post("/files/s/:id/tokens", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.MintBucketAccessToken(fileService))
+	app.Get("/files/s/:id/tokens", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.ListBucketTokens(fileService))
+	app.Delete("/files/s/:id/tokens", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.RevokeBucketTokens(fileService))
+	app.Delete("/files/s/:id/tokens/:tokenId", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.RevokeBucketToken(fileService))
+	app.Get("/files/s/:id/lockouts", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.ListBucketLockouts(fileService))
+	app.Put("/files/s/:id/password", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.SetBucketPassword(fileService))
+	app.Delete("/files/s/:id/password", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.RemoveBucketPassword(fileService))
+	app.Get("/files/s/:id/d/:filename", middleware.BucketDownloadAuth(fileService, authService), handlers.DownloadFile(fileService))
+	app.Get("/files/s/:id/t/:filename", middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeRead), handlers.Thumbnail(fileService))
+	app.Post("/files/s/:id/d/:filename/links", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.CreateShareLink(fileService))
+	app.Get("/files/s/:id/d/:filename/links", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.ListShareLinks(fileService))
+	app.Delete("/files/s/:id/d/:filename/links/:linkId", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.RevokeShareLink(fileService))
+	app.Get("/files/s/:id/archive.zip", middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeRead), handlers.DownloadBucketArchive(fileService))
+	app.Delete("/files/s/:id", middleware.JWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeAdmin), handlers.DeleteBucket(fileService))
+	app.Delete("/files/s/:id/d/:filename", middleware.OptionalJWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeDelete), handlers.DeleteFile(fileService))
+	app.Put("/files/s/:id/d/:filename", middleware.OptionalJWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeWrite), handlers.ReplaceFile(fileService))
+	app.Patch("/files/s/:id/d/:filename", middleware.OptionalJWTAuth(authService), middleware.BucketPasswordAuth(fileService, authService, file.PrivilegeWrite), handlers.MoveFile(fileService))
+
+	app.Get("/me/usage", middleware.JWTAuth(authService), handlers.GetUsage(fileService))
+	app.Get("/me/buckets", middleware.JWTAuth(authService), handlers.ListBuckets(fileService))
 }
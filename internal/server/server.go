@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/cthulhu-platform/gateway/internal/middleware"
 	"github.com/cthulhu-platform/gateway/internal/pkg"
 	"github.com/cthulhu-platform/gateway/internal/routes"
 	"github.com/cthulhu-platform/gateway/internal/service/auth"
@@ -49,8 +50,12 @@ func (s *FiberServer) Start() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
 	// SETUP DEPENDENCIES
+	// Request bodies are streamed so multipart uploads reach S3 without being buffered.
+	// fasthttp does not apply BodyLimit to streamed bodies; middleware.BodyLimit does instead.
 	app := fiber.New(fiber.Config{
-		BodyLimit: pkg.BODY_LIMIT_MB * 1024 * 1024,
+		BodyLimit:                    pkg.BODY_LIMIT_MB * 1024 * 1024,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	slog.Info("secret", "github", pkg.GITHUB_CLIENT_ID)
@@ -58,11 +63,16 @@ func (s *FiberServer) Start() {
 	// SETUP MIDDLEWARE
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: pkg.CORS_ORIGIN,
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Bucket-Access",
+		AllowMethods: "GET,POST,PUT,PATCH,HEAD,DELETE,OPTIONS",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Bucket-Access, X-Upload-Token, X-Content-SHA256, Range, If-Range, " +
+			"Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum, Upload-Defer-Length",
+		ExposeHeaders: "Content-Disposition, Content-Length, Content-Range, Accept-Ranges, Last-Modified, ETag, Digest, Location, " +
+			"Tus-Resumable, Tus-Version, Tus-Extension, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Metadata, " +
+			"X-Bucket-Id, X-File-Id, X-Skipped-Files",
 	}))
 	app.Use(slogfiber.New(logger))
 	app.Use(recover.New())
+	app.Use(middleware.BodyLimit(pkg.BODY_LIMIT_MB*1024*1024, routes.StreamedRoutes...))
 
 	// ROUTES
 	app.Get("/", func(c *fiber.Ctx) error {
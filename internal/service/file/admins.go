@@ -0,0 +1,168 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+// NewAdmin names the user to make a bucket admin, by user ID or by email
+type NewAdmin struct {
+	UserID string
+	Email  string
+}
+
+// AddBucketAdmin lets actorID, an admin of the bucket, share its management with another user
+func (s *localFileService) AddBucketAdmin(ctx context.Context, bucketID, actorID string, target NewAdmin) (*BucketAdminsResponse, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	target.UserID = strings.TrimSpace(target.UserID)
+	target.Email = strings.TrimSpace(target.Email)
+	if (target.UserID == "") == (target.Email == "") {
+		return nil, errors.New("exactly one of user_id or email is required")
+	}
+
+	authRepo, err := s.authRepo()
+	if err != nil {
+		return nil, err
+	}
+	var user *local.User
+	if target.UserID != "" {
+		user, err = authRepo.GetUserByID(target.UserID)
+	} else {
+		user, err = authRepo.GetUserByEmail(target.Email)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.DeletedAt != nil {
+		return nil, ErrUserNotFound
+	}
+
+	isAdmin, err := s.fileRepo.IsBucketAdmin(user.ID, bucket.ID)
+	if err != nil {
+		return nil, err
+	}
+	if isAdmin {
+		return nil, ErrAlreadyBucketAdmin
+	}
+
+	admin := &local.BucketAdmin{
+		UserID:    user.ID,
+		BucketID:  bucket.ID,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := s.fileRepo.AddBucketAdmin(admin); err != nil {
+		return nil, err
+	}
+
+	return s.GetBucketAdmins(ctx, bucket.ID)
+}
+
+// RemoveBucketAdmin lets actorID, an admin of the bucket, revoke another admin or step down.
+// The owner can only stop being an admin by transferring ownership first.
+func (s *localFileService) RemoveBucketAdmin(ctx context.Context, bucketID, actorID, userID string) (*BucketAdminsResponse, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	if bucket.OwnerID != nil && *bucket.OwnerID == userID {
+		return nil, ErrCannotRemoveOwner
+	}
+
+	isAdmin, err := s.fileRepo.IsBucketAdmin(userID, bucket.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		return nil, ErrAdminNotFound
+	}
+
+	if err := s.fileRepo.RemoveBucketAdmin(userID, bucket.ID); err != nil {
+		return nil, err
+	}
+
+	return s.GetBucketAdmins(ctx, bucket.ID)
+}
+
+// TransferBucketOwnership hands a bucket from its owner, actorID, to another of its admins.
+// The previous owner stays an admin.
+func (s *localFileService) TransferBucketOwnership(ctx context.Context, bucketID, actorID, newOwnerID string) (*BucketAdminsResponse, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	if bucket.OwnerID == nil || *bucket.OwnerID != actorID {
+		return nil, ErrNotBucketOwner
+	}
+	if newOwnerID == actorID {
+		return nil, errors.New("user already owns the bucket")
+	}
+
+	// Ownership only moves between admins, so the new owner has been let in explicitly before
+	isAdmin, err := s.fileRepo.IsBucketAdmin(newOwnerID, bucket.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		return nil, ErrAdminNotFound
+	}
+
+	if err := s.fileRepo.SetBucketOwner(bucket.ID, newOwnerID); err != nil {
+		return nil, err
+	}
+
+	return s.GetBucketAdmins(ctx, bucket.ID)
+}
+
+// getAdministeredBucket loads an unexpired bucket that userID administers
+func (s *localFileService) getAdministeredBucket(bucketID, userID string) (*local.Bucket, error) {
+	if bucketID == "" {
+		return nil, errors.New("bucket id is required")
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
+	}
+
+	if err := s.requireBucketAdmin(bucketID, userID); err != nil {
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+// authRepo gives access to user records, which only the local authentication connection exposes
+func (s *localFileService) authRepo() (local.AuthRepository, error) {
+	authConn := s.conns.Authentication
+	if authConn == nil {
+		return nil, errors.New("authentication connection not configured")
+	}
+
+	// Type assert to local connection to access GetRepo
+	type repoGetter interface {
+		GetRepo() local.AuthRepository
+	}
+
+	localAuthConn, ok := authConn.(repoGetter)
+	if !ok {
+		return nil, errors.New("authentication connection does not support repository access")
+	}
+
+	return localAuthConn.GetRepo(), nil
+}
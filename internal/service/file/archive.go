@@ -0,0 +1,229 @@
+package file
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+// BucketArchive streams every file of a bucket as a ZIP archive.
+// Entries are fetched from S3 one at a time while the archive is written,
+// so neither temp files nor whole objects are held by the gateway.
+type BucketArchive struct {
+	BucketID string
+	Skipped  []string // Files left out because their download limit is used up, known before streaming
+	entries  []archiveEntry
+	used     map[string]bool // Entry names taken so far
+	service  *localFileService
+}
+
+type archiveEntry struct {
+	name string
+	file *local.File
+}
+
+// skippedFilesEntry names the entry listing the files left out of an archive
+const skippedFilesEntry = "SKIPPED_FILES.txt"
+
+func (s *localFileService) ArchiveBucket(ctx context.Context, bucketID string) (*BucketArchive, error) {
+	if bucketID == "" {
+		return nil, errors.New("bucket id is required")
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
+	}
+
+	if s.filemanager() == nil {
+		return nil, errors.New("filemanager connection not configured")
+	}
+
+	dbFiles, err := s.fileRepo.GetFilesByBucketID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool, len(dbFiles))
+	entries := make([]archiveEntry, 0, len(dbFiles))
+	skipped := make([]string, 0)
+	for _, dbFile := range dbFiles {
+		name := uniqueArchiveName(archiveEntryName(filePath(dbFile)), used)
+		if downloadsUsedUp(dbFile) {
+			skipped = append(skipped, name)
+			continue
+		}
+		entries = append(entries, archiveEntry{name: name, file: dbFile})
+	}
+
+	return &BucketArchive{
+		BucketID: bucketID,
+		Skipped:  skipped,
+		entries:  entries,
+		used:     used,
+		service:  s,
+	}, nil
+}
+
+// Stream writes the archive to w. Every file counts one download once its entry has been written,
+// and burn-after-reading applies as usual. Files whose download limit is used up are left out and
+// listed in a SKIPPED_FILES.txt entry at the end. Headers are already sent when this runs,
+// so an error leaves a truncated archive; the files of entries that were not finished are not counted.
+func (a *BucketArchive) Stream(ctx context.Context, w io.Writer) error {
+	fm := a.service.filemanager()
+	zw := zip.NewWriter(w)
+
+	skipped := a.Skipped
+	for _, entry := range a.entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		written, err := a.writeEntry(ctx, zw, w, fm, entry)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", entry.name, err)
+		}
+		if !written {
+			skipped = append(skipped, entry.name)
+		}
+	}
+
+	if len(skipped) > 0 {
+		if err := writeSkippedFiles(zw, uniqueArchiveName(skippedFilesEntry, a.used), skipped); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// writeEntry adds one file to the archive and counts its download once the entry has reached w.
+// It reports false when the file was left out because its download limit was used up meanwhile.
+func (a *BucketArchive) writeEntry(ctx context.Context, zw *zip.Writer, w io.Writer, fm filemanager.FilemanagerConnection, entry archiveEntry) (bool, error) {
+	s := a.service
+
+	// Another download may have used up the file since the archive was listed
+	file, err := s.fileRepo.GetFileByID(entry.file.ID)
+	if err != nil {
+		return false, err
+	}
+	if file == nil || downloadsUsedUp(file) {
+		return false, nil
+	}
+
+	storageID, objectName, err := splitS3Key(file.S3Key)
+	if err != nil {
+		return false, err
+	}
+
+	obj, err := fm.Download(ctx, storageID, objectName)
+	if err != nil {
+		return false, err
+	}
+	defer obj.Body.Close()
+
+	// Entries are stored rather than deflated: shared artifacts are mostly compressed already,
+	// and it keeps compression CPU out of the download path
+	header := &zip.FileHeader{
+		Name:     entry.name,
+		Method:   zip.Store,
+		Modified: time.Unix(file.CreatedAt, 0),
+	}
+	ew, err := zw.CreateHeader(header)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(ew, obj.Body); err != nil {
+		return false, err
+	}
+	if err := flushArchive(zw, w); err != nil {
+		return false, err
+	}
+
+	count, ok, err := s.fileRepo.ConsumeDownload(file.ID)
+	if err != nil {
+		return true, err
+	}
+	if !ok {
+		// A download elsewhere took the last allowance while the entry was being written
+		slog.Warn("archived file past its download limit", "bucket_id", file.BucketID, "string_id", file.StringID)
+		return true, nil
+	}
+
+	if file.MaxDownloads != nil && count >= *file.MaxDownloads {
+		bucket, err := s.fileRepo.GetBucketByID(file.BucketID)
+		if err == nil && bucket != nil && bucket.BurnAfterReading {
+			go s.burnFile(file)
+		}
+	}
+
+	return true, nil
+}
+
+// flushArchive pushes everything written so far to the client, so a write error shows up before a download is counted
+func flushArchive(zw *zip.Writer, w io.Writer) error {
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// writeSkippedFiles adds a text entry listing the files that were left out of the archive
+func writeSkippedFiles(zw *zip.Writer, name string, skipped []string) error {
+	ew, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("These files were left out because their download limit is used up:\n\n")
+	for _, name := range skipped {
+		b.WriteString(name)
+		b.WriteString("\n")
+	}
+	_, err = io.WriteString(ew, b.String())
+	return err
+}
+
+// downloadsUsedUp reports whether a file has no downloads left
+func downloadsUsedUp(file *local.File) bool {
+	return file.MaxDownloads != nil && file.DownloadCount >= *file.MaxDownloads
+}
+
+// archiveEntryName turns a stored file path into a safe ZIP entry name that keeps its folders
+func archiveEntryName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "file"
+	}
+	return name
+}
+
+// uniqueArchiveName returns name, or "name (n).ext" when it is already taken, and marks the result as used
+func uniqueArchiveName(name string, used map[string]bool) string {
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; used[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
@@ -0,0 +1,180 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+const (
+	// Failed password attempts allowed before lockouts start. A bucket gets more than one IP
+	// so that a single guesser cannot lock its legitimate users out as easily.
+	ipFreeAttempts     = 5
+	bucketFreeAttempts = 20
+
+	// Every failure past the free attempts doubles the lockout, from lockoutBase up to maxLockout
+	lockoutBase = 30 * time.Second
+	maxLockout  = time.Hour
+
+	// authFailureWindow is how long failures are remembered after the last one
+	authFailureWindow = time.Hour
+
+	// maxConcurrentPasswordChecks caps Argon2 verifications running at once, each of which takes argon2Memory
+	maxConcurrentPasswordChecks = 4
+
+	// bucketLockoutHistory is how many recent lockouts are shown to bucket admins
+	bucketLockoutHistory = 100
+)
+
+// TooManyAttemptsError is returned while a bucket or client IP is locked out after failed password attempts
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many failed password attempts; retry in %d seconds", int64(e.RetryAfter.Seconds()))
+}
+
+func (e *TooManyAttemptsError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// BucketLockoutInfo describes a lockout of a bucket to its admins
+type BucketLockoutInfo struct {
+	Scope       string `json:"scope"` // "bucket" when the bucket was locked, "ip" when the client IP was
+	ClientIP    string `json:"client_ip"`
+	Failures    int64  `json:"failures"`
+	LockedUntil int64  `json:"locked_until"`
+	CreatedAt   int64  `json:"created_at"`
+	Active      bool   `json:"active"`
+}
+
+// ListBucketLockouts shows a bucket admin the recent lockouts caused by password guessing on the bucket
+func (s *localFileService) ListBucketLockouts(ctx context.Context, bucketID, userID string) ([]BucketLockoutInfo, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	lockouts, err := s.fileRepo.GetBucketLockouts(bucket.ID, bucketLockoutHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	infos := make([]BucketLockoutInfo, 0, len(lockouts))
+	for _, lockout := range lockouts {
+		infos = append(infos, BucketLockoutInfo{
+			Scope:       lockout.Scope,
+			ClientIP:    lockout.ClientIP,
+			Failures:    lockout.Failures,
+			LockedUntil: lockout.LockedUntil,
+			CreatedAt:   lockout.CreatedAt,
+			Active:      lockout.LockedUntil > now,
+		})
+	}
+	return infos, nil
+}
+
+// checkPasswordAttempt refuses an attempt while the bucket or the client IP is locked out
+func (s *localFileService) checkPasswordAttempt(bucketID, clientIP string) error {
+	now := time.Now()
+	var lockedUntil int64
+	for _, scope := range passwordAttemptScopes(bucketID, clientIP) {
+		failure, err := s.fileRepo.GetAuthFailure(scope.name, scope.key)
+		if err != nil {
+			return err
+		}
+		if failure != nil && failure.LockedUntil != nil && *failure.LockedUntil > lockedUntil {
+			lockedUntil = *failure.LockedUntil
+		}
+	}
+
+	if lockedUntil > now.Unix() {
+		return &TooManyAttemptsError{RetryAfter: time.Unix(lockedUntil, 0).Sub(now).Round(time.Second)}
+	}
+	return nil
+}
+
+// recordPasswordFailure counts a failed attempt against the bucket and the client IP,
+// locking out whichever has run out of free attempts
+func (s *localFileService) recordPasswordFailure(bucketID, clientIP string) {
+	now := time.Now()
+	for _, scope := range passwordAttemptScopes(bucketID, clientIP) {
+		failures, err := s.fileRepo.RecordAuthFailure(scope.name, scope.key, now.Unix(), now.Add(-authFailureWindow).Unix())
+		if err != nil {
+			slog.Error("failed to record password failure", "scope", scope.name, "key", scope.key, "error", err)
+			continue
+		}
+		if failures < scope.freeAttempts {
+			continue
+		}
+
+		lockedUntil := now.Add(lockoutDuration(failures - scope.freeAttempts)).Unix()
+		if err := s.fileRepo.LockAuthFailure(scope.name, scope.key, lockedUntil); err != nil {
+			slog.Error("failed to lock out password attempts", "scope", scope.name, "key", scope.key, "error", err)
+			continue
+		}
+
+		lockout := &local.BucketLockout{
+			BucketID:    bucketID,
+			Scope:       scope.name,
+			ClientIP:    clientIP,
+			Failures:    failures,
+			LockedUntil: lockedUntil,
+			CreatedAt:   now.Unix(),
+		}
+		if err := s.fileRepo.CreateBucketLockout(lockout); err != nil {
+			slog.Error("failed to record bucket lockout", "bucket_id", bucketID, "error", err)
+		}
+		slog.Warn("password attempts locked out", "bucket_id", bucketID, "scope", scope.name,
+			"client_ip", clientIP, "failures", failures, "locked_until", lockedUntil)
+	}
+}
+
+// clearPasswordFailures forgets the failures of a client IP once it has entered a correct password.
+// The bucket's count is left to expire, so a guesser cannot reset it with a password of their own.
+func (s *localFileService) clearPasswordFailures(clientIP string) {
+	if clientIP == "" {
+		return
+	}
+	if err := s.fileRepo.ClearAuthFailure(local.AuthScopeIP, clientIP); err != nil {
+		slog.Error("failed to clear password failures", "client_ip", clientIP, "error", err)
+	}
+}
+
+// acquirePasswordCheck waits for one of the maxConcurrentPasswordChecks slots; release it when done
+func (s *localFileService) acquirePasswordCheck(ctx context.Context) (release func(), err error) {
+	select {
+	case s.passwordChecks <- struct{}{}:
+		return func() { <-s.passwordChecks }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type passwordAttemptScope struct {
+	name         string
+	key          string
+	freeAttempts int64
+}
+
+func passwordAttemptScopes(bucketID, clientIP string) []passwordAttemptScope {
+	scopes := []passwordAttemptScope{{name: local.AuthScopeBucket, key: bucketID, freeAttempts: bucketFreeAttempts}}
+	if clientIP != "" {
+		scopes = append(scopes, passwordAttemptScope{name: local.AuthScopeIP, key: clientIP, freeAttempts: ipFreeAttempts})
+	}
+	return scopes
+}
+
+// lockoutDuration is lockoutBase doubled once per failure past the free attempts, capped at maxLockout
+func lockoutDuration(excess int64) time.Duration {
+	d := lockoutBase
+	for i := int64(0); i < excess && d < maxLockout; i++ {
+		d *= 2
+	}
+	return min(d, maxLockout)
+}
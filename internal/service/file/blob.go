@@ -0,0 +1,158 @@
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"github.com/google/uuid"
+)
+
+// blobStorageID is the S3 prefix holding file contents shared across buckets.
+// Bucket IDs are 10 characters long, so it never collides with a bucket's prefix.
+const blobStorageID = "blobs"
+
+// storedBlob is the shared object a file's content ended up in
+type storedBlob struct {
+	s3Key  string
+	size   int64
+	sha256 string
+}
+
+// storeBlob stores body once per distinct content and takes a reference to the resulting blob.
+// The caller hands the reference back with releaseBlob if no files row ends up using it.
+// expected is the hex SHA-256 sent by the client, if any: when a blob with that digest already
+// exists the body is only hashed to check it, not uploaded again.
+func (s *localFileService) storeBlob(ctx context.Context, fm filemanager.FilemanagerConnection, contentType string, body io.Reader, expected string) (*storedBlob, error) {
+	if expected != "" {
+		// The reference is taken before reading so the blob cannot be swept in the meantime
+		blob, err := s.fileRepo.ReferenceBlob(expected)
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			digest := sha256.New()
+			_, err := io.Copy(digest, body)
+			if err == nil && hex.EncodeToString(digest.Sum(nil)) != expected {
+				err = ErrContentDigestMismatch
+			}
+			if err != nil {
+				s.releaseBlob(ctx, blob.S3Key)
+				return nil, err
+			}
+			return &storedBlob{s3Key: blob.S3Key, size: blob.Size, sha256: blob.SHA256}, nil
+		}
+	}
+
+	name := uuid.New().String()
+	key := blobStorageID + "/" + name
+	size, sum, err := uploadHashed(ctx, fm, blobStorageID, name, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	if expected != "" && expected != sum {
+		deleteBlobObject(ctx, fm, key)
+		return nil, ErrContentDigestMismatch
+	}
+
+	blob, err := s.fileRepo.AcquireBlob(&local.Blob{
+		SHA256:    sum,
+		S3Key:     key,
+		Size:      size,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		deleteBlobObject(ctx, fm, key)
+		return nil, err
+	}
+	if blob.S3Key != key {
+		// The same content was stored before, so the copy just uploaded is dropped
+		deleteBlobObject(ctx, fm, key)
+	}
+
+	return &storedBlob{s3Key: blob.S3Key, size: size, sha256: sum}, nil
+}
+
+// copyBlob is storeBlob for an object already in S3 whose digest S3 has checked: the object is
+// copied into a new blob inside S3, unless a blob with the same digest exists, and never read.
+func (s *localFileService) copyBlob(ctx context.Context, fm filemanager.FilemanagerConnection, storageID, objectName, contentType string, size int64, sum string) (*storedBlob, error) {
+	// The reference is taken before anything else so the blob cannot be swept in the meantime
+	blob, err := s.fileRepo.ReferenceBlob(sum)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		return &storedBlob{s3Key: blob.S3Key, size: blob.Size, sha256: blob.SHA256}, nil
+	}
+
+	name := uuid.New().String()
+	key := blobStorageID + "/" + name
+	if err := fm.Copy(ctx, storageID, objectName, blobStorageID, name, contentType); err != nil {
+		return nil, err
+	}
+
+	blob, err = s.fileRepo.AcquireBlob(&local.Blob{
+		SHA256:    sum,
+		S3Key:     key,
+		Size:      size,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		deleteBlobObject(ctx, fm, key)
+		return nil, err
+	}
+	if blob.S3Key != key {
+		// The same content was stored in the meantime, so the copy is dropped
+		deleteBlobObject(ctx, fm, key)
+	}
+
+	return &storedBlob{s3Key: blob.S3Key, size: size, sha256: sum}, nil
+}
+
+// releaseBlob hands back a reference taken by storeBlob that no files row uses
+func (s *localFileService) releaseBlob(ctx context.Context, s3Key string) {
+	if err := s.fileRepo.ReleaseBlob(s3Key); err != nil {
+		slog.Error("failed to release blob", "s3_key", s3Key, "error", err)
+		return
+	}
+	s.purgeUnreferencedBlobs(ctx)
+}
+
+// purgeUnreferencedBlobs deletes the blobs no file references any more.
+// It runs after files are removed; an object that fails to delete is only logged and left behind.
+func (s *localFileService) purgeUnreferencedBlobs(ctx context.Context) {
+	blobs, err := s.fileRepo.DeleteUnreferencedBlobs()
+	if err != nil {
+		slog.Error("failed to purge unreferenced blobs", "error", err)
+		return
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return
+	}
+	for _, blob := range blobs {
+		deleteBlobObject(ctx, fm, blob.S3Key)
+	}
+}
+
+func deleteBlobObject(ctx context.Context, fm filemanager.FilemanagerConnection, s3Key string) {
+	storageID, objectName, err := splitS3Key(s3Key)
+	if err == nil {
+		err = fm.Delete(ctx, storageID, objectName)
+	}
+	if err != nil {
+		slog.Error("failed to delete blob object", "s3_key", s3Key, "error", err)
+	}
+}
+
+// isBlobKey reports whether an s3_key points at a shared blob rather than an object owned by one file
+func isBlobKey(s3Key string) bool {
+	return strings.HasPrefix(s3Key, blobStorageID+"/")
+}
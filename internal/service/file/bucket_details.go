@@ -0,0 +1,141 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+)
+
+const (
+	maxTitleLength       = 200   // Characters
+	maxDescriptionLength = 10000 // Characters of markdown
+	maxLabels            = 20
+	maxLabelLength       = 50 // Characters
+)
+
+// BucketDetailsUpdate changes the descriptive fields of a bucket. A nil field is left as it is;
+// an empty title or description, or an empty list of labels, clears it.
+type BucketDetailsUpdate struct {
+	Title       *string
+	Description *string
+	Labels      *[]string
+}
+
+// UpdateBucketDetails lets a bucket admin, or a token holder with the write privilege,
+// change the title, description and labels recipients see
+func (s *localFileService) UpdateBucketDetails(ctx context.Context, bucketID string, access BucketAccess, update BucketDetailsUpdate) (*filemanager.BucketMetadata, error) {
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
+	}
+	if err := s.requireBucketPrivilege(bucketID, access, PrivilegeWrite); err != nil {
+		return nil, err
+	}
+
+	if update.Title != nil {
+		if bucket.Title, err = normalizeTitle(update.Title); err != nil {
+			return nil, err
+		}
+	}
+	if update.Description != nil {
+		if bucket.Description, err = normalizeDescription(update.Description); err != nil {
+			return nil, err
+		}
+	}
+	if update.Labels != nil {
+		if bucket.Labels, err = normalizeLabels(*update.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	bucket.UpdatedAt = time.Now().Unix()
+	if err := s.fileRepo.UpdateBucketDetails(bucket); err != nil {
+		return nil, err
+	}
+
+	return s.RetrieveFileBucket(ctx, bucketID, BucketListingOptions{})
+}
+
+// normalizeBucketDetails validates the descriptive fields of a new bucket
+func normalizeBucketDetails(opts UploadOptions) (title, description *string, labels []string, err error) {
+	if title, err = normalizeTitle(opts.Title); err != nil {
+		return nil, nil, nil, err
+	}
+	if description, err = normalizeDescription(opts.Description); err != nil {
+		return nil, nil, nil, err
+	}
+	if labels, err = normalizeLabels(opts.Labels); err != nil {
+		return nil, nil, nil, err
+	}
+	return title, description, labels, nil
+}
+
+// normalizeTitle trims a title to a single line; nil means no title
+func normalizeTitle(title *string) (*string, error) {
+	if title == nil {
+		return nil, nil
+	}
+	trimmed := strings.TrimSpace(*title)
+	if trimmed == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(trimmed, "\r\n") {
+		return nil, fmt.Errorf("title must be a single line")
+	}
+	if utf8.RuneCountInString(trimmed) > maxTitleLength {
+		return nil, fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+	return &trimmed, nil
+}
+
+// normalizeDescription keeps the markdown as written, minus surrounding blank space; nil means no description
+func normalizeDescription(description *string) (*string, error) {
+	if description == nil {
+		return nil, nil
+	}
+	trimmed := strings.TrimSpace(*description)
+	if trimmed == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(trimmed) > maxDescriptionLength {
+		return nil, fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	return &trimmed, nil
+}
+
+// normalizeLabels trims labels and drops empty ones and repeats, compared without case
+func normalizeLabels(labels []string) ([]string, error) {
+	seen := make(map[string]bool, len(labels))
+	normalized := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[strings.ToLower(label)] {
+			continue
+		}
+		if strings.ContainsAny(label, "\r\n") {
+			return nil, fmt.Errorf("labels must be single lines")
+		}
+		if utf8.RuneCountInString(label) > maxLabelLength {
+			return nil, fmt.Errorf("labels must be at most %d characters", maxLabelLength)
+		}
+		seen[strings.ToLower(label)] = true
+		normalized = append(normalized, label)
+	}
+	if len(normalized) > maxLabels {
+		return nil, fmt.Errorf("a bucket can have at most %d labels", maxLabels)
+	}
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+	return normalized, nil
+}
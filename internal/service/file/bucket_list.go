@@ -0,0 +1,115 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+const (
+	// defaultBucketPageSize is how many buckets a listing returns when no limit is given
+	defaultBucketPageSize = 50
+	// maxBucketPageSize caps the limit of a bucket listing
+	maxBucketPageSize = 200
+)
+
+// ListBucketsOptions selects the page and order of a bucket listing
+type ListBucketsOptions struct {
+	Sort   string // created_at (default), expires_at, size or files
+	Order  string // asc or desc; defaults to desc
+	Limit  int    // 0 = default page size
+	Offset int
+}
+
+// BucketSummary describes one bucket of a listing
+type BucketSummary struct {
+	BucketID  string  `json:"bucket_id"`
+	Title     *string `json:"title,omitempty"`
+	FileCount int64   `json:"file_count"`
+	TotalSize int64   `json:"total_size"`
+	Protected bool    `json:"protected"`
+	IsOwner   bool    `json:"is_owner"` // False for buckets the user only administers
+	CreatedAt int64   `json:"created_at"`
+	ExpiresAt *int64  `json:"expires_at,omitempty"`
+}
+
+// BucketList is one page of the buckets a user administers
+type BucketList struct {
+	Buckets []BucketSummary `json:"buckets"`
+	Total   int64           `json:"total"` // Buckets across all pages
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+	Sort    string          `json:"sort"`
+	Order   string          `json:"order"`
+}
+
+// ListBuckets lists the unexpired buckets userID administers, newest first unless opts says otherwise
+func (s *localFileService) ListBuckets(ctx context.Context, userID string, opts ListBucketsOptions) (*BucketList, error) {
+	if userID == "" {
+		return nil, errors.New("user id is required")
+	}
+
+	page := local.BucketPage{
+		Sort:       opts.Sort,
+		Descending: true,
+		Limit:      opts.Limit,
+		Offset:     opts.Offset,
+	}
+	switch opts.Sort {
+	case "":
+		page.Sort = local.BucketSortCreatedAt
+	case local.BucketSortCreatedAt, local.BucketSortExpiresAt, local.BucketSortSize, local.BucketSortFiles:
+	default:
+		return nil, fmt.Errorf("sort must be one of %s, %s, %s or %s",
+			local.BucketSortCreatedAt, local.BucketSortExpiresAt, local.BucketSortSize, local.BucketSortFiles)
+	}
+	switch opts.Order {
+	case "", "desc":
+	case "asc":
+		page.Descending = false
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+	if page.Limit < 0 || page.Limit > maxBucketPageSize {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxBucketPageSize)
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultBucketPageSize
+	}
+	if page.Offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+
+	summaries, total, err := s.fileRepo.GetBucketSummariesByUserID(userID, page, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	list := &BucketList{
+		Buckets: make([]BucketSummary, 0, len(summaries)),
+		Total:   total,
+		Limit:   page.Limit,
+		Offset:  page.Offset,
+		Sort:    page.Sort,
+		Order:   "desc",
+	}
+	if !page.Descending {
+		list.Order = "asc"
+	}
+	for _, summary := range summaries {
+		list.Buckets = append(list.Buckets, BucketSummary{
+			BucketID:  summary.BucketID,
+			Title:     summary.Title,
+			FileCount: summary.FileCount,
+			TotalSize: summary.TotalSize,
+			Protected: summary.Protected,
+			IsOwner:   summary.IsOwner,
+			CreatedAt: summary.CreatedAt,
+			ExpiresAt: summary.ExpiresAt,
+		})
+	}
+	return list, nil
+}
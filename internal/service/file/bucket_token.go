@@ -6,45 +6,97 @@ import (
 
 	"github.com/cthulhu-platform/gateway/internal/pkg"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 const (
 	bucketTokenExpiry = 30 * time.Minute
 )
 
+// Privileges a bucket access token can grant. Every bucket route declares the one it needs.
+// Bucket admins get admin when they authenticate; tokens they mint for others grant read, write or delete.
+const (
+	PrivilegeRead   = "read"   // List and download files
+	PrivilegeWrite  = "write"  // Add, replace and move files, and edit the bucket details
+	PrivilegeDelete = "delete" // Delete files
+	PrivilegeAdmin  = "admin"  // Everything, including deleting the bucket
+)
+
+var privilegeNames = map[string]bool{
+	PrivilegeRead:   true,
+	PrivilegeWrite:  true,
+	PrivilegeDelete: true,
+	PrivilegeAdmin:  true,
+}
+
+// ParsePrivileges validates a requested privilege list and removes duplicates
+func ParsePrivileges(privileges []string) ([]string, error) {
+	if len(privileges) == 0 {
+		return nil, fmt.Errorf("at least one privilege is required")
+	}
+
+	seen := make(map[string]bool, len(privileges))
+	parsed := make([]string, 0, len(privileges))
+	for _, privilege := range privileges {
+		if !privilegeNames[privilege] {
+			return nil, fmt.Errorf("unknown privilege %q; must be read, write, delete or admin", privilege)
+		}
+		if !seen[privilege] {
+			seen[privilege] = true
+			parsed = append(parsed, privilege)
+		}
+	}
+	return parsed, nil
+}
+
 // BucketAccessClaims represents JWT claims for bucket access tokens
 type BucketAccessClaims struct {
-	BucketID    string   `json:"bucket_id"`
-	Privileges  []string `json:"privileges"` // ["read", "write", etc.]
-	UserID      *string  `json:"user_id,omitempty"`
-	AuthTokenID *string  `json:"auth_token_id,omitempty"` // JTI from auth token
+	BucketID        string   `json:"bucket_id"`
+	PasswordVersion int64    `json:"password_version"` // Bucket password the token was issued for
+	Privileges      []string `json:"privileges"`       // ["read", "write", etc.]
+	UserID          *string  `json:"user_id,omitempty"`
+	AuthTokenID     *string  `json:"auth_token_id,omitempty"` // JTI from auth token
 	jwt.RegisteredClaims
 }
 
+// Allows reports whether the token grants privilege. The admin privilege grants every other one.
+func (c *BucketAccessClaims) Allows(privilege string) bool {
+	for _, granted := range c.Privileges {
+		if granted == privilege || granted == PrivilegeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
 // BucketAccessTokenResponse represents the API response for bucket authentication
 type BucketAccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"` // seconds
+	AccessToken string   `json:"access_token"`
+	ExpiresIn   int      `json:"expires_in"` // seconds
+	Privileges  []string `json:"privileges,omitempty"`
 }
 
-// GenerateBucketAccessToken generates a JWT token for bucket access
-func GenerateBucketAccessToken(bucketID string, userID *string, authTokenID *string, privileges []string) (string, error) {
+// GenerateBucketAccessToken generates a JWT token for bucket access, with a fresh jti in its claims.
+// The token only stays valid while the bucket's password version is passwordVersion.
+func GenerateBucketAccessToken(bucketID string, passwordVersion int64, userID *string, authTokenID *string, privileges []string) (string, *BucketAccessClaims, error) {
 	if bucketID == "" {
-		return "", fmt.Errorf("bucket_id is required")
+		return "", nil, fmt.Errorf("bucket_id is required")
 	}
 
 	jwtSecret := pkg.JWT_SECRET
 	if jwtSecret == "" {
-		return "", fmt.Errorf("JWT_SECRET environment variable is required")
+		return "", nil, fmt.Errorf("JWT_SECRET environment variable is required")
 	}
 
 	now := time.Now()
 	claims := &BucketAccessClaims{
-		BucketID:    bucketID,
-		Privileges:  privileges,
-		UserID:      userID,
-		AuthTokenID: authTokenID,
+		BucketID:        bucketID,
+		PasswordVersion: passwordVersion,
+		Privileges:      privileges,
+		UserID:          userID,
+		AuthTokenID:     authTokenID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(now.Add(bucketTokenExpiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -54,10 +106,10 @@ func GenerateBucketAccessToken(bucketID string, userID *string, authTokenID *str
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
-		return "", fmt.Errorf("failed to sign bucket access token: %w", err)
+		return "", nil, fmt.Errorf("failed to sign bucket access token: %w", err)
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
 // ValidateBucketAccessToken validates a bucket access token and returns its claims
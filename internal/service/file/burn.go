@@ -0,0 +1,38 @@
+package file
+
+import (
+	"io"
+	"sync"
+)
+
+// burnOnClose wraps a download body and starts burn once the body is closed after being read to the end.
+// fasthttp only reads the last bytes of a streamed body after writing everything before them, and
+// closes it once the response is done. A body closed early, such as when the client went away, leaves
+// the file in place: the download still counts, but nobody got the file, so it is not destroyed.
+type burnOnClose struct {
+	io.ReadCloser
+	once sync.Once
+	size int64 // Length of the body; fasthttp stops reading after that many bytes rather than at io.EOF
+	n    int64 // Bytes read so far
+	read bool  // The body was read to the end
+	burn func()
+}
+
+func (b *burnOnClose) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF || (b.size > 0 && b.n >= b.size) {
+		b.read = true
+	}
+	return n, err
+}
+
+func (b *burnOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	if b.read {
+		b.once.Do(func() {
+			go b.burn()
+		})
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+)
+
+// uploadHashed streams body to S3 like UploadStream and returns the hex SHA-256 of what was stored
+func uploadHashed(ctx context.Context, fm filemanager.FilemanagerConnection, storageID, filename, contentType string, body io.Reader) (int64, string, error) {
+	digest := sha256.New()
+	size, err := fm.UploadStream(ctx, storageID, filename, contentType, io.TeeReader(body, digest))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// parseContentSHA256 normalizes an X-Content-SHA256 value to lowercase hex.
+// An empty value means the client sent no digest.
+func parseContentSHA256(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return "", nil
+	}
+	if sum, err := hex.DecodeString(value); err != nil || len(sum) != sha256.Size {
+		return "", errors.New("X-Content-SHA256 must be a hex encoded SHA-256 digest")
+	}
+	return value, nil
+}
+
+// ContentDigest formats a hex SHA-256 as the value of a Digest header (RFC 3230)
+func ContentDigest(sha256Hex string) string {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// ContentETag formats a hex SHA-256 as a strong entity tag
+func ContentETag(sha256Hex string) string {
+	return `"` + sha256Hex + `"`
+}
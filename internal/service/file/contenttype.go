@@ -0,0 +1,136 @@
+package file
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+// sniffLength is how many leading bytes content type detection looks at (see http.DetectContentType)
+const sniffLength = 512
+
+// detectedType is the content type a file is stored with, along with what the client claimed
+type detectedType struct {
+	contentType string // Sniffed from the first bytes, refined by the extension where the bytes are ambiguous
+	declared    string // Content-Type sent by the client, empty when none
+	mismatch    bool   // The declared type or the file extension disagrees with the content
+}
+
+// apply stores the detected type on a files row
+func (d detectedType) apply(file *local.File) {
+	file.ContentType = d.contentType
+	file.DeclaredContentType = nil
+	if d.declared != "" {
+		file.DeclaredContentType = &d.declared
+	}
+	file.ContentTypeMismatch = d.mismatch
+}
+
+// sniffContentType peeks at the start of body to detect its type. The returned reader
+// yields the whole body, including the bytes that were looked at.
+func sniffContentType(name, declared string, body io.Reader) (detectedType, io.Reader, error) {
+	buffered := bufio.NewReaderSize(body, sniffLength)
+	head, err := buffered.Peek(sniffLength)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return detectedType{}, nil, err
+	}
+	return detectContentType(name, declared, head), buffered, nil
+}
+
+// detectContentType decides the type of a file from its leading bytes and its name.
+// The bytes win; the extension only narrows a generic result, such as a .docx that sniffs as a ZIP
+// or a .csv that sniffs as plain text. The client's Content-Type is recorded but never trusted.
+func detectContentType(name, declared string, head []byte) detectedType {
+	sniffed := http.DetectContentType(head)
+	byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+
+	detected := detectedType{contentType: sniffed, declared: strings.TrimSpace(declared)}
+	if byExtension != "" && refinesSniffedType(mediaType(sniffed), mediaType(byExtension)) {
+		detected.contentType = byExtension
+	}
+
+	stored := mediaType(detected.contentType)
+	if byExtension != "" && canonicalMediaType(mediaType(byExtension)) != canonicalMediaType(stored) {
+		detected.mismatch = true
+	}
+	// application/octet-stream is what clients send when they do not know, so it claims nothing
+	if claimed := mediaType(detected.declared); claimed != "" && claimed != "application/octet-stream" &&
+		canonicalMediaType(claimed) != canonicalMediaType(stored) {
+		detected.mismatch = true
+	}
+
+	return detected
+}
+
+// refinesSniffedType reports whether the type implied by an extension is a more precise
+// reading of a generic sniffed type rather than a contradiction of it
+func refinesSniffedType(sniffed, byExtension string) bool {
+	switch sniffed {
+	case "text/plain":
+		return isTextType(byExtension)
+	case "text/xml":
+		return byExtension == "application/xml" || strings.HasSuffix(byExtension, "+xml")
+	case "application/zip":
+		// Office documents, Java archives, e-books and the like are ZIP containers
+		return strings.HasPrefix(byExtension, "application/vnd.") ||
+			byExtension == "application/java-archive" || byExtension == "application/epub+zip"
+	case "application/ogg":
+		return byExtension == "audio/ogg" || byExtension == "video/ogg"
+	case "application/octet-stream":
+		// Types with a known signature would have been sniffed, so claiming one here is a contradiction
+		return !sniffableTypes[canonicalMediaType(byExtension)] && !isTextType(byExtension)
+	default:
+		return false
+	}
+}
+
+// sniffableTypes are the binary types http.DetectContentType recognizes by signature
+var sniffableTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true, "image/bmp": true, "image/x-icon": true,
+	"audio/wav": true, "audio/aiff": true, "audio/mpeg": true, "audio/midi": true, "application/ogg": true,
+	"video/mp4": true, "video/webm": true, "video/avi": true,
+	"application/pdf": true, "application/postscript": true, "application/zip": true, "application/gzip": true,
+	"application/x-rar-compressed": true, "application/wasm": true, "application/vnd.ms-fontobject": true,
+	"font/ttf": true, "font/otf": true, "font/collection": true, "font/woff": true, "font/woff2": true,
+}
+
+// mediaTypeAliases maps the spellings of a type that different sources use to a single one
+var mediaTypeAliases = map[string]string{
+	"application/x-gzip":       "application/gzip",
+	"audio/wave":               "audio/wav",
+	"audio/x-wav":              "audio/wav",
+	"audio/mp3":                "audio/mpeg",
+	"image/vnd.microsoft.icon": "image/x-icon",
+	"video/x-msvideo":          "video/avi",
+	"application/x-javascript": "text/javascript",
+	"application/javascript":   "text/javascript",
+	"text/xml":                 "application/xml",
+}
+
+func canonicalMediaType(mediaType string) string {
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+func isTextType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/json" || mediaType == "application/xml" ||
+		mediaType == "application/javascript" || mediaType == "application/x-sh"
+}
+
+// mediaType returns the lowercased type of a Content-Type value without its parameters
+func mediaType(contentType string) string {
+	value, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,40 @@
+package file
+
+import (
+	"fmt"
+	"mime"
+)
+
+// ContentDisposition builds a Content-Disposition value such as `attachment; filename="report.pdf"`.
+// Non-ASCII names are encoded as RFC 2231 filename* parameters.
+func ContentDisposition(disposition, filename string) string {
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); value != "" {
+		return value
+	}
+	// FormatMediaType rejects names it cannot encode; fall back to a quoted name
+	return fmt.Sprintf("%s; filename=%q", disposition, filename)
+}
+
+// inlineContentTypes are the types a browser may render straight from a download URL without
+// running anything: raster images, plain text and audio/video. HTML, SVG, XML and PDF are left out.
+var inlineContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"image/bmp":  true,
+	"text/plain": true,
+	"audio/mpeg": true,
+	"audio/ogg":  true,
+	"audio/wav":  true,
+	"audio/webm": true,
+	"video/mp4":  true,
+	"video/ogg":  true,
+	"video/webm": true,
+}
+
+// inlineAllowed reports whether a file of contentType may be served with Content-Disposition: inline
+func inlineAllowed(contentType string) bool {
+	return inlineContentTypes[canonicalMediaType(mediaType(contentType))]
+}
@@ -2,12 +2,105 @@ package file
 
 import (
 	"context"
-
-	"mime/multipart"
+	"errors"
+	"io"
 
 	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
 )
 
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrNotBucketAdmin = errors.New("user is not a bucket admin")
+	ErrFileNotFound   = errors.New("file not found")
+	ErrBucketExpired  = errors.New("bucket expired")
+
+	ErrNotBucketOwner     = errors.New("user is not the bucket owner")
+	ErrCannotRemoveOwner  = errors.New("the bucket owner cannot be removed; transfer ownership first")
+	ErrAlreadyBucketAdmin = errors.New("user is already a bucket admin")
+	ErrAdminNotFound      = errors.New("user is not an admin of this bucket")
+	ErrUserNotFound       = errors.New("user not found")
+
+	ErrDownloadLimitReached = errors.New("download limit reached")
+
+	ErrTooManyAttempts = errors.New("too many failed password attempts")
+
+	ErrBucketTokenRevoked  = errors.New("bucket access token has been revoked")
+	ErrBucketTokenNotFound = errors.New("bucket access token not found")
+
+	ErrShareLinkNotFound = errors.New("share link not found")
+	ErrShareLinkExpired  = errors.New("share link expired")
+	ErrInvalidShareLink  = errors.New("invalid share link")
+
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadSessionExpired  = errors.New("upload session expired")
+	ErrInvalidUploadToken    = errors.New("invalid upload token")
+	ErrUploadIncomplete      = errors.New("upload incomplete")
+
+	ErrTusUploadNotFound      = errors.New("upload not found")
+	ErrTusUploadLocked        = errors.New("upload is being written by another request")
+	ErrTusOffsetMismatch      = errors.New("upload offset does not match")
+	ErrTusChunkTooLarge       = errors.New("chunk exceeds the upload length")
+	ErrTusChecksumMismatch    = errors.New("checksum mismatch")
+	ErrTusUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+	ErrTusStagingFull         = errors.New("upload staging space is full, try again later")
+
+	ErrContentDigestMismatch = errors.New("content does not match X-Content-SHA256")
+
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	ErrBucketQuotaExceeded  = errors.New("bucket quota exceeded")
+	ErrFileTooLarge         = errors.New("file exceeds the maximum file size")
+
+	ErrThumbnailUnsupported = errors.New("file cannot be previewed as an image")
+	ErrThumbnailUnavailable = errors.New("thumbnails are not available for files with a download limit")
+	ErrThumbnailBusy        = errors.New("too many thumbnails are being rendered, try again shortly")
+)
+
+// UploadOptions carries the bucket settings chosen by the uploader
+type UploadOptions struct {
+	Password  *string
+	ExpiresAt *int64 // Unix timestamp, nil = never expires
+
+	DefaultMaxDownloads *int64   // Download limit of each file without its own, kept for files added later; nil = unlimited
+	FileMaxDownloads    []*int64 // Per-file limits in upload order; nil entries use DefaultMaxDownloads
+	BurnAfterReading    bool     // Delete each file once its last allowed download finishes
+
+	Title       *string // Shown to recipients instead of the bucket ID
+	Description *string // Markdown shown to recipients
+	Labels      []string
+}
+
+// UploadPart is one file read from an upload request
+type UploadPart struct {
+	Name        string
+	ContentType string
+	Body        io.Reader // Must be read to the end or abandoned before the next file is requested
+	SHA256      string    // Expected hex SHA-256 sent by the client, empty when none
+}
+
+// UploadSource yields the files of an upload request one at a time, so they can be streamed
+// to storage without buffering the request. Form fields may arrive after the files, which is why
+// Options is only available once NextFile has returned io.EOF.
+type UploadSource interface {
+	NextFile() (*UploadPart, error)
+	Options() (UploadOptions, error)
+}
+
+// DownloadOptions carries the conditional and range headers of a download request
+type DownloadOptions struct {
+	Range   string // Range header, e.g. "bytes=0-1023"
+	IfRange string // If-Range header; a stale validator means the whole file is sent
+	Inline  bool   // Ask to display the file in the browser; only honoured for safe content types
+	Head    bool   // HEAD request: only the headers are sent, so nothing is fetched, counted or burnt
+
+	ShareLinkID string // Share link the download goes through, counted along with the file
+}
+
+// BucketAccess is who acts on a bucket: a logged-in user, the holder of a bucket access token, or both
+type BucketAccess struct {
+	UserID string              // Logged-in user, "" when anonymous
+	Claims *BucketAccessClaims // Validated X-Bucket-Access token, nil when none was sent
+}
+
 type AdminInfo struct {
 	UserID    string  `json:"user_id"`
 	Email     string  `json:"email"`
@@ -24,10 +117,42 @@ type BucketAdminsResponse struct {
 }
 
 type FileService interface {
-	UploadFiles(ctx context.Context, files []*multipart.FileHeader, userID *string, password *string) (*filemanager.UploadResult, error)
-	DownloadFile(ctx context.Context, storageID, stringID string) (*filemanager.DownloadResult, error)
-	RetrieveFileBucket(ctx context.Context, storageID string) (*filemanager.BucketMetadata, error)
+	UploadFiles(ctx context.Context, src UploadSource, userID *string, clientIP string) (*filemanager.UploadResult, error)
+	InitiateUpload(ctx context.Context, files []DeclaredFile, userID *string, clientIP string, opts UploadOptions) (*PresignedUpload, error)
+	CompleteUpload(ctx context.Context, bucketID, uploadToken string) (*filemanager.UploadResult, error)
+	AddFiles(ctx context.Context, bucketID string, src UploadSource, access BucketAccess) (*filemanager.UploadResult, error)
+	DownloadFile(ctx context.Context, storageID, stringID string, opts DownloadOptions) (*filemanager.DownloadResult, error)
+	Thumbnail(ctx context.Context, bucketID, stringID string, width int) (*filemanager.DownloadResult, error)
+	RetrieveFileBucket(ctx context.Context, storageID string, opts BucketListingOptions) (*filemanager.BucketMetadata, error)
+	ArchiveBucket(ctx context.Context, bucketID string) (*BucketArchive, error)
 	GetBucketAdmins(ctx context.Context, bucketID string) (*BucketAdminsResponse, error)
-	IsBucketProtected(ctx context.Context, bucketID string) (bool, *string, error)
-	AuthenticateBucket(ctx context.Context, bucketID, password string, userID *string, authTokenID *string) (string, error)
+	AddBucketAdmin(ctx context.Context, bucketID, actorID string, target NewAdmin) (*BucketAdminsResponse, error)
+	RemoveBucketAdmin(ctx context.Context, bucketID, actorID, userID string) (*BucketAdminsResponse, error)
+	TransferBucketOwnership(ctx context.Context, bucketID, actorID, newOwnerID string) (*BucketAdminsResponse, error)
+	IsBucketProtected(ctx context.Context, bucketID string) (bool, int64, error)
+	AuthenticateBucket(ctx context.Context, bucketID, password, clientIP string, userID *string, authTokenID *string) (string, error)
+	ListBucketLockouts(ctx context.Context, bucketID, userID string) ([]BucketLockoutInfo, error)
+	MintBucketAccessToken(ctx context.Context, bucketID, userID string, privileges []string) (*BucketAccessTokenResponse, error)
+	CheckBucketToken(ctx context.Context, bucketID, tokenID string) error
+	ListBucketTokens(ctx context.Context, bucketID, userID string) ([]BucketTokenInfo, error)
+	RevokeBucketToken(ctx context.Context, bucketID, tokenID, userID string) error
+	RevokeBucketTokens(ctx context.Context, bucketID, userID string) (int64, error)
+	UpdateBucketDetails(ctx context.Context, bucketID string, access BucketAccess, update BucketDetailsUpdate) (*filemanager.BucketMetadata, error)
+	SetBucketPassword(ctx context.Context, bucketID, userID string, password *string) error
+	DeleteBucket(ctx context.Context, bucketID, userID string) error
+	PurgeExpiredBuckets(ctx context.Context) (int, error)
+	PurgeStaleUploads(ctx context.Context) (int, error)
+	CreateTusUpload(ctx context.Context, userID *string, clientIP string, opts TusCreateOptions) (*TusUpload, error)
+	GetTusUpload(ctx context.Context, id string) (*TusUpload, error)
+	WriteTusChunk(ctx context.Context, id string, offset int64, body io.Reader, checksum *TusChecksum) (*TusUpload, error)
+	TerminateTusUpload(ctx context.Context, id string) error
+	DeleteFile(ctx context.Context, bucketID, stringID string, access BucketAccess) error
+	ReplaceFile(ctx context.Context, bucketID, stringID string, access BucketAccess, src UploadSource) (*filemanager.FileInfo, error)
+	MoveFile(ctx context.Context, bucketID, stringID string, access BucketAccess, move FileMove) (*filemanager.FileInfo, error)
+	CreateShareLink(ctx context.Context, bucketID, stringID, userID string, opts ShareLinkOptions) (*ShareLink, error)
+	ListShareLinks(ctx context.Context, bucketID, stringID, userID string) ([]*ShareLink, error)
+	RevokeShareLink(ctx context.Context, bucketID, stringID, linkID, userID string) error
+	CheckShareLink(ctx context.Context, bucketID, stringID, token string) (string, error)
+	GetUsage(ctx context.Context, userID string) (*UsageReport, error)
+	ListBuckets(ctx context.Context, userID string, opts ListBucketsOptions) (*BucketList, error)
 }
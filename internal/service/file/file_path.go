@@ -0,0 +1,152 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+const (
+	maxFilePathLength = 1024 // Characters of the folder and name together
+	maxFolderDepth    = 32
+)
+
+// BucketListingOptions narrows down and shapes the files RetrieveFileBucket lists
+type BucketListingOptions struct {
+	Prefix string // Only list files whose full path (e.g. "docs/img/a.png") starts with Prefix
+	Tree   bool   // Also nest the listed files in their folders
+}
+
+// FileMove renames a file, moves it to another folder, or both. A nil field is left as it is.
+type FileMove struct {
+	Name *string // New file name, without a folder
+	Path *string // New folder, e.g. "docs/img"; "" moves the file to the top level
+}
+
+// MoveFile lets a bucket admin, or a token holder with the write privilege, rename a file or move it to another folder.
+// Only the files row changes: the string_id, the stored content and every link to the file stay the same.
+func (s *localFileService) MoveFile(ctx context.Context, bucketID, stringID string, access BucketAccess, move FileMove) (*filemanager.FileInfo, error) {
+	if bucketID == "" || stringID == "" {
+		return nil, errors.New("storage id and string id are required")
+	}
+
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.requireBucketPrivilege(bucketID, access, PrivilegeWrite); err != nil {
+		return nil, err
+	}
+
+	folder, name := file.Path, file.OriginalName
+	if move.Path != nil {
+		folder = cleanFolder(*move.Path)
+	}
+	if move.Name != nil {
+		name = strings.TrimSpace(*move.Name)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, errors.New("name must be a file name without a folder; use path to move the file")
+		}
+	}
+	if err := checkFilePath(folder, name); err != nil {
+		return nil, err
+	}
+
+	if err := s.fileRepo.MoveFile(file.ID, folder, name); err != nil {
+		return nil, err
+	}
+	file.Path, file.OriginalName = folder, name
+
+	info := newFileInfo(file)
+	return &info, nil
+}
+
+// splitFilePath turns the name a file was uploaded with, which may be a relative path such as
+// "docs/img/a.png" from a folder upload, into its folder and file name. Backslashes count as
+// separators, and empty, "." and ".." segments are resolved without ever leaving the bucket.
+func splitFilePath(name string) (folder, base string, err error) {
+	cleaned := path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	folder, base = path.Split(cleaned)
+	folder = strings.Trim(folder, "/")
+	if base == "" {
+		return "", "", fmt.Errorf("%q has no file name", name)
+	}
+	if err := checkFilePath(folder, base); err != nil {
+		return "", "", err
+	}
+	return folder, base, nil
+}
+
+// cleanFolder normalizes a folder the way splitFilePath does; "" and "/" are the top level
+func cleanFolder(folder string) string {
+	return strings.Trim(path.Clean("/"+strings.ReplaceAll(folder, `\`, "/")), "/")
+}
+
+// checkFilePath enforces the length and depth limits on a file's folder and name
+func checkFilePath(folder, name string) error {
+	full := path.Join(folder, name)
+	if utf8.RuneCountInString(full) > maxFilePathLength {
+		return fmt.Errorf("%s: path must be at most %d characters", full, maxFilePathLength)
+	}
+	if folder != "" && strings.Count(folder, "/")+1 > maxFolderDepth {
+		return fmt.Errorf("%s: folders may be nested at most %d deep", full, maxFolderDepth)
+	}
+	return nil
+}
+
+// filePath is the full path of a file within its bucket, e.g. "docs/img/a.png"
+func filePath(file *local.File) string {
+	return path.Join(file.Path, file.OriginalName)
+}
+
+// buildFolderTree nests files in the folders of their paths. Folders are sorted by name;
+// files keep their order within each folder.
+func buildFolderTree(files []filemanager.FileInfo) *filemanager.FolderNode {
+	root := newFolderNode("", "")
+	folders := map[string]*filemanager.FolderNode{"": root}
+	for _, f := range files {
+		folder := folderNode(folders, f.Path)
+		folder.Files = append(folder.Files, f)
+	}
+	sortFolders(root)
+	return root
+}
+
+// folderNode returns the node of folder p, creating it and any missing parents
+func folderNode(folders map[string]*filemanager.FolderNode, p string) *filemanager.FolderNode {
+	if node, ok := folders[p]; ok {
+		return node
+	}
+	parentPath, name := path.Split(p)
+	parent := folderNode(folders, strings.TrimSuffix(parentPath, "/"))
+	node := newFolderNode(name, p)
+	parent.Folders = append(parent.Folders, node)
+	folders[p] = node
+	return node
+}
+
+func newFolderNode(name, p string) *filemanager.FolderNode {
+	return &filemanager.FolderNode{
+		Name:    name,
+		Path:    p,
+		Folders: make([]*filemanager.FolderNode, 0),
+		Files:   make([]filemanager.FileInfo, 0),
+	}
+}
+
+func sortFolders(node *filemanager.FolderNode) {
+	slices.SortFunc(node.Folders, func(a, b *filemanager.FolderNode) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, child := range node.Folders {
+		sortFolders(child)
+	}
+}
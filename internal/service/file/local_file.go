@@ -5,13 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand/v2"
-	"mime/multipart"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cthulhu-platform/gateway/internal/microservices"
 	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/pkg"
 	"github.com/cthulhu-platform/gateway/internal/repository/local"
 	"github.com/google/uuid"
 )
@@ -19,20 +22,95 @@ import (
 type localFileService struct {
 	conns    *microservices.ServiceConnectionContainer
 	fileRepo local.FileRepository
+
+	// Redirect downloads to presigned S3 URLs instead of proxying them
+	redirectDownloads bool
+	redirectExpiry    time.Duration
+
+	// Lifetime of presigned PutObject URLs handed out by InitiateUpload
+	presignUploadExpiry time.Duration
+
+	// Idle time after which an unfinished tus upload is discarded
+	tusUploadExpiry time.Duration
+	// Largest length a tus upload may declare
+	tusMaxSize int64
+	// Total length unfinished tus uploads may declare together
+	tusStagingMax int64
+	// Serializes the staging space check with the creation of the upload it admits
+	tusStaging sync.Mutex
+	// Serializes requests writing to the same tus upload, upload ID -> *sync.Mutex
+	tusLocks sync.Map
+	// Why storing a complete tus upload as a file last failed, upload ID -> error
+	tusFinishErrors sync.Map
+
+	// Limits for logged-in uploaders, and for anonymous uploads per client IP
+	userQuota      Quota
+	anonymousQuota Quota
+
+	// Recent revocation lookups of bucket access tokens
+	tokenRevocations *revocationCache
+
+	// Slots for Argon2 password verifications, which each take argon2Memory
+	passwordChecks chan struct{}
+	// Slots for thumbnail renders, which each decode an image in memory
+	thumbnailRenders chan struct{}
 }
 
 func NewLocalFileService(conns *microservices.ServiceConnectionContainer, fileRepo local.FileRepository) *localFileService {
-	return &localFileService{
-		conns:    conns,
-		fileRepo: fileRepo,
+	redirectExpiry, err := time.ParseDuration(pkg.DOWNLOAD_REDIRECT_EXPIRY)
+	if err != nil || redirectExpiry <= 0 {
+		redirectExpiry = 5 * time.Minute // Default
+	}
+
+	presignUploadExpiry, err := time.ParseDuration(pkg.S3_PRESIGN_UPLOAD_EXPIRY)
+	if err != nil || presignUploadExpiry <= 0 {
+		presignUploadExpiry = time.Hour // Default
+	}
+
+	tusUploadExpiry, err := time.ParseDuration(pkg.TUS_UPLOAD_EXPIRY)
+	if err != nil || tusUploadExpiry <= 0 {
+		tusUploadExpiry = 24 * time.Hour // Default
 	}
-}
 
-func (s *localFileService) UploadFiles(ctx context.Context, files []*multipart.FileHeader, userID *string, password *string) (*filemanager.UploadResult, error) {
-	if len(files) == 0 {
-		return nil, errors.New("no files provided")
+	tusMaxSizeMB, err := strconv.ParseInt(pkg.TUS_MAX_SIZE_MB, 10, 64)
+	if err != nil || tusMaxSizeMB <= 0 {
+		tusMaxSizeMB = 5120 // Default
 	}
 
+	tusStagingMaxMB, err := strconv.ParseInt(pkg.TUS_STAGING_MAX_MB, 10, 64)
+	if err != nil || tusStagingMaxMB <= 0 {
+		tusStagingMaxMB = 51200 // Default
+	}
+
+	return &localFileService{
+		conns:             conns,
+		fileRepo:          fileRepo,
+		redirectDownloads: strings.ToLower(pkg.DOWNLOAD_REDIRECT) == "true",
+		redirectExpiry:    redirectExpiry,
+
+		presignUploadExpiry: presignUploadExpiry,
+		tusUploadExpiry:     tusUploadExpiry,
+		tusMaxSize:          tusMaxSizeMB << 20,
+		tusStagingMax:       tusStagingMaxMB << 20,
+
+		userQuota: newQuota(pkg.QUOTA_USER_STORAGE_MB, pkg.QUOTA_USER_BUCKETS, pkg.QUOTA_USER_FILE_SIZE_MB, Quota{
+			MaxBytes:    quotaLimit(10 << 30),
+			MaxBuckets:  quotaLimit(100),
+			MaxFileSize: quotaLimit(5 << 30),
+		}),
+		anonymousQuota: newQuota(pkg.QUOTA_ANONYMOUS_STORAGE_MB, pkg.QUOTA_ANONYMOUS_BUCKETS, pkg.QUOTA_ANONYMOUS_FILE_SIZE_MB, Quota{
+			MaxBytes:    quotaLimit(1 << 30),
+			MaxBuckets:  quotaLimit(20),
+			MaxFileSize: quotaLimit(512 << 20),
+		}),
+
+		tokenRevocations: newRevocationCache(),
+		passwordChecks:   make(chan struct{}, maxConcurrentPasswordChecks),
+		thumbnailRenders: make(chan struct{}, maxConcurrentThumbnails),
+	}
+}
+
+func (s *localFileService) UploadFiles(ctx context.Context, src UploadSource, userID *string, clientIP string) (*filemanager.UploadResult, error) {
 	fm := s.filemanager()
 	if fm == nil {
 		return nil, errors.New("filemanager connection not configured")
@@ -43,182 +121,352 @@ func (s *localFileService) UploadFiles(ctx context.Context, files []*multipart.F
 		Success:       false,
 	}
 
+	// Nothing reaches S3 for an uploader who is already out of quota
+	quota, err := s.reserveQuota(userID, clientIP, true, 0)
+	if err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+
+	// Generate storage_id (bucket_id) up front, the objects are stored under it before the bucket row exists
+	storageID, err := s.reserveStorageID()
+	if err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+
+	// Stream each file to S3 as it arrives; nothing is recorded until the whole request has been read
+	staged, rejected, err := s.stageFiles(ctx, src, quota)
+	res.Rejected = rejected
+	if err == nil && len(staged) == 0 {
+		err = noFilesError(rejected)
+	}
+	if err != nil {
+		s.discardStaged(ctx, staged)
+		res.Error = err.Error()
+		return res, err
+	}
+
+	now := time.Now().Unix()
+	opts, err := src.Options()
+	limits := resolveDownloadLimits(len(staged), opts.DefaultMaxDownloads, opts.FileMaxDownloads)
+	if err == nil {
+		err = checkUploadOptions(opts, limits, now)
+	}
+	if err != nil {
+		s.discardStaged(ctx, staged)
+		res.Error = err.Error()
+		return res, err
+	}
+
+	if _, err := s.createBucket(storageID, userID, clientIP, opts, now); err != nil {
+		s.discardStaged(ctx, staged)
+		res.Error = err.Error()
+		return res, err
+	}
+
+	fileInfos, totalSize, err := s.recordFiles(storageID, staged, limits, userID, now)
+	if err != nil {
+		// Nothing outside this request knows the bucket yet, so drop it along with its files
+		s.discardStaged(ctx, staged[len(fileInfos):])
+		if purgeErr := s.purgeBucket(ctx, storageID); purgeErr != nil {
+			slog.Error("failed to clean up upload", "bucket_id", storageID, "error", purgeErr)
+		}
+		res.Error = err.Error()
+		return res, err
+	}
+
+	res.StorageID = storageID
+	res.Files = fileInfos
+	res.TotalSize = totalSize
+	res.ExpiresAt = opts.ExpiresAt
+	res.Success = true
+	return res, nil
+}
+
+// reserveStorageID generates a storage ID that no bucket uses yet
+func (s *localFileService) reserveStorageID() (string, error) {
 	// Generate storage_id (bucket_id) - 10 char alphanumeric
 	storageID := s.generateStorageID()
 
 	// Check if bucket already exists
 	existingBucket, err := s.fileRepo.GetBucketByID(storageID)
 	if err != nil {
-		res.Error = err.Error()
-		return res, err
+		return "", err
 	}
 	if existingBucket != nil {
 		// Retry with new storage_id
 		storageID = s.generateStorageID()
 		existingBucket, err = s.fileRepo.GetBucketByID(storageID)
 		if err != nil {
-			res.Error = err.Error()
-			return res, err
+			return "", err
 		}
 		if existingBucket != nil {
-			res.Error = "failed to generate unique storage id"
-			return res, errors.New(res.Error)
+			return "", errors.New("failed to generate unique storage id")
 		}
 	}
 
+	return storageID, nil
+}
+
+// createBucket stores a new bucket under storageID and makes a valid logged-in uploader its admin.
+// An anonymous bucket records clientIP instead, so it counts against that IP's quota.
+func (s *localFileService) createBucket(storageID string, userID *string, clientIP string, opts UploadOptions, now int64) (*local.Bucket, error) {
+	title, description, labels, err := normalizeBucketDetails(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Hash password if provided
 	var passwordHash *string
-	if password != nil && *password != "" {
-		hash, err := HashPassword(*password)
+	if opts.Password != nil && *opts.Password != "" {
+		hash, err := HashPassword(*opts.Password)
 		if err != nil {
-			res.Error = err.Error()
-			return res, fmt.Errorf("failed to hash password: %w", err)
+			return nil, fmt.Errorf("failed to hash password: %w", err)
 		}
 		passwordHash = &hash
 	}
 
 	// Create bucket in DB
-	now := time.Now().Unix()
 	bucket := &local.Bucket{
 		ID:           storageID,
 		PasswordHash: passwordHash,
 		CreatedAt:    now,
 		UpdatedAt:    now,
+		ExpiresAt:    opts.ExpiresAt,
+
+		DefaultMaxDownloads: opts.DefaultMaxDownloads,
+		BurnAfterReading:    opts.BurnAfterReading,
+
+		Title:       title,
+		Description: description,
+		Labels:      labels,
+	}
+	if (userID == nil || *userID == "") && clientIP != "" {
+		bucket.UploaderIP = &clientIP
+	}
+	if err := s.storeBucket(bucket, userID); err != nil {
+		return nil, err
 	}
+
+	return bucket, nil
+}
+
+// storeBucket inserts a bucket row and makes a valid logged-in uploader its owner and first admin
+func (s *localFileService) storeBucket(bucket *local.Bucket, userID *string) error {
+	// Validate user exists through authentication microservice
+	bucket.OwnerID = s.validOwner(userID)
 	if err := s.fileRepo.CreateBucket(bucket); err != nil {
+		return err
+	}
+
+	if bucket.OwnerID != nil {
+		admin := &local.BucketAdmin{
+			UserID:    *bucket.OwnerID,
+			BucketID:  bucket.ID,
+			CreatedAt: bucket.CreatedAt,
+		}
+		if err := s.fileRepo.AddBucketAdmin(admin); err != nil {
+			// Log error but don't fail upload
+			slog.Error("failed to add bucket owner as admin", "bucket_id", bucket.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *localFileService) AddFiles(ctx context.Context, bucketID string, src UploadSource, access BucketAccess) (*filemanager.UploadResult, error) {
+	if bucketID == "" {
+		return nil, errors.New("bucket id is required")
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
+	}
+
+	if err := s.requireBucketPrivilege(bucketID, access, PrivilegeWrite); err != nil {
+		return nil, err
+	}
+
+	res := &filemanager.UploadResult{
+		TransactionID: uuid.New().String(),
+		Success:       false,
+	}
+
+	ownerID, clientIP := bucketPayer(bucket, access)
+	quota, err := s.reserveQuota(ownerID, clientIP, false, 0)
+	if err != nil {
 		res.Error = err.Error()
 		return res, err
 	}
 
-	// Add bucket admin if user is logged in (validate user exists first)
-	if userID != nil && *userID != "" {
-		// Validate user exists through authentication microservice
-		authConn := s.conns.Authentication
-		if authConn != nil {
-			valid, err := authConn.ValidateUserID(*userID)
-			if err == nil && valid {
-				admin := &local.BucketAdmin{
-					UserID:    *userID,
-					BucketID:  storageID,
-					CreatedAt: now,
-				}
-				if err := s.fileRepo.AddBucketAdmin(admin); err != nil {
-					// Log error but don't fail upload
-					_ = err
-				}
-			}
-		}
+	staged, rejected, err := s.stageFiles(ctx, src, quota)
+	res.Rejected = rejected
+	if err == nil && len(staged) == 0 {
+		err = noFilesError(rejected)
+	}
+	if err != nil {
+		s.discardStaged(ctx, staged)
+		res.Error = err.Error()
+		return res, err
 	}
 
-	// Open all files
-	objects := make([]filemanager.UploadObject, 0, len(files))
-	closers := make([]io.Closer, 0, len(files))
-	for _, fh := range files {
-		file, err := fh.Open()
-		if err != nil {
-			res.Error = err.Error()
-			return res, err
-		}
-		closers = append(closers, file)
-		objects = append(objects, filemanager.UploadObject{
-			Name:        fh.Filename,
-			Size:        fh.Size,
-			ContentType: fh.Header.Get("Content-Type"),
-			Body:        file,
-		})
+	// Files added later inherit the bucket's default download limit
+	limits := resolveDownloadLimits(len(staged), bucket.DefaultMaxDownloads, nil)
+	fileInfos, totalSize, err := s.recordFiles(bucketID, staged, limits, ownerID, time.Now().Unix())
+	if err != nil {
+		s.discardStaged(ctx, staged[len(fileInfos):])
+		res.Error = err.Error()
+		return res, err
+	}
+
+	res.StorageID = bucketID
+	res.Files = fileInfos
+	res.TotalSize = totalSize
+	res.ExpiresAt = bucket.ExpiresAt
+	res.Success = true
+	return res, nil
+}
+
+// stagedFile is a file whose content is already stored in S3 but that has no files row yet
+type stagedFile struct {
+	stringID string
+	name     string
+	detected detectedType
+	size     int64
+	sha256   string
+	s3Key    string // Shared blob holding the content; the staged file holds a reference to it
+}
+
+// stageFiles stores the content of every file of src as a deduplicated blob, hashing it on the way.
+// Each file's type is sniffed from its first bytes rather than taken from the client, and every
+// byte is charged against quota, which stops the upload once a limit is hit.
+// A file whose digest differs from the X-Content-SHA256 sent with it is dropped and listed as rejected.
+// On error the returned slice still lists the files staged so far, so the caller can discard them.
+func (s *localFileService) stageFiles(ctx context.Context, src UploadSource, quota *uploadQuota) ([]stagedFile, []filemanager.RejectedFile, error) {
+	fm := s.filemanager()
+	if fm == nil {
+		return nil, nil, errors.New("filemanager connection not configured")
 	}
-	defer func() {
-		for _, f := range closers {
-			f.Close()
+
+	staged := make([]stagedFile, 0)
+	rejected := make([]filemanager.RejectedFile, 0)
+	for {
+		part, err := src.NextFile()
+		if err == io.EOF {
+			return staged, rejected, nil
+		}
+		if err != nil {
+			return staged, rejected, err
 		}
-	}()
 
-	// Process each file: generate string_id, upload to S3, save to DB
-	totalSize := int64(0)
-	fileInfos := make([]filemanager.FileInfo, 0, len(objects))
+		expected, err := parseContentSHA256(part.SHA256)
+		if err != nil {
+			rejected = append(rejected, filemanager.RejectedFile{OriginalName: part.Name, Error: err.Error()})
+			continue
+		}
+		if _, _, err := splitFilePath(part.Name); err != nil {
+			rejected = append(rejected, filemanager.RejectedFile{OriginalName: part.Name, Error: err.Error()})
+			continue
+		}
 
-	for _, obj := range objects {
 		// Generate unique string_id (UUID)
 		stringID := s.generateUniqueStringID(ctx)
 		if stringID == "" {
-			res.Error = "failed to generate unique string_id"
-			return res, errors.New(res.Error)
+			return staged, rejected, errors.New("failed to generate unique string_id")
 		}
 
-		// Upload to S3 using bucket_id/string_id as key
-		s3Key := storageID + "/" + stringID
-		uploadObj := filemanager.UploadObject{
-			Name:        stringID, // Use string_id as the S3 object name
-			Size:        obj.Size,
-			ContentType: obj.ContentType,
-			Body:        obj.Body,
+		var blob *storedBlob
+		detected, body, err := sniffContentType(part.Name, part.ContentType, quota.limit(part.Body))
+		if err == nil {
+			blob, err = s.storeBlob(ctx, fm, detected.contentType, body, expected)
 		}
-
-		// Upload to S3 using filemanager
-		// We need to access the local implementation
-		// For now, we'll use a type assertion - this works because we know we're using local
-		type uploader interface {
-			UploadSingleObject(ctx context.Context, storageID, stringID string, obj filemanager.UploadObject) error
+		if quotaErr := quota.exceeded(); quotaErr != nil {
+			// The storage layer may wrap the read error, so the quota reports it first-hand
+			return staged, rejected, quotaErr
 		}
-
-		uploaderFM, ok := fm.(uploader)
-		if !ok {
-			res.Error = "filemanager does not support single object upload"
-			return res, errors.New(res.Error)
+		if errors.Is(err, ErrContentDigestMismatch) {
+			rejected = append(rejected, filemanager.RejectedFile{OriginalName: part.Name, Error: err.Error()})
+			continue
 		}
-
-		// Upload to S3
-		if err := uploaderFM.UploadSingleObject(ctx, storageID, stringID, uploadObj); err != nil {
-			res.Error = err.Error()
-			return res, err
+		if err != nil {
+			return staged, rejected, err
 		}
 
-		// Validate user_id if provided before storing as owner
-		var ownerID *string
-		if userID != nil && *userID != "" {
-			authConn := s.conns.Authentication
-			if authConn != nil {
-				valid, err := authConn.ValidateUserID(*userID)
-				if err == nil && valid {
-					ownerID = userID
-				}
-			}
-		}
+		staged = append(staged, stagedFile{
+			stringID: stringID,
+			name:     part.Name,
+			detected: detected,
+			size:     blob.size,
+			sha256:   blob.sha256,
+			s3Key:    blob.s3Key,
+		})
+	}
+}
 
-		// Save file metadata to DB
+// recordFiles saves a files row for each staged object. maxDownloads holds the download limit
+// of each file, in the same order as staged. On error the returned infos cover the rows written so far.
+func (s *localFileService) recordFiles(storageID string, staged []stagedFile, maxDownloads []*int64, userID *string, now int64) ([]filemanager.FileInfo, int64, error) {
+	// Validate user_id if provided before storing as owner
+	ownerID := s.validOwner(userID)
+
+	totalSize := int64(0)
+	fileInfos := make([]filemanager.FileInfo, 0, len(staged))
+
+	for i, f := range staged {
+		folder, name, err := splitFilePath(f.name)
+		if err != nil {
+			return fileInfos, totalSize, err
+		}
 		dbFile := &local.File{
-			StringID:     stringID,
+			StringID:     f.stringID,
 			BucketID:     storageID,
-			OriginalName: obj.Name,
+			OriginalName: name,
+			Path:         folder,
 			OwnerID:      ownerID,
-			Size:         obj.Size,
-			ContentType:  obj.ContentType,
-			S3Key:        s3Key,
+			Size:         f.size,
+			S3Key:        f.s3Key,
 			CreatedAt:    now,
+			MaxDownloads: maxDownloads[i],
+		}
+		f.detected.apply(dbFile)
+		if f.sha256 != "" {
+			dbFile.SHA256 = &f.sha256
 		}
 		if err := s.fileRepo.CreateFile(dbFile); err != nil {
-			res.Error = err.Error()
-			return res, err
+			return fileInfos, totalSize, err
 		}
 
-		fileInfos = append(fileInfos, filemanager.FileInfo{
-			OriginalName: obj.Name,
-			StringID:     stringID,
-			Key:          s3Key,
-			Size:         obj.Size,
-			ContentType:  obj.ContentType,
-		})
-		totalSize += obj.Size
+		fileInfos = append(fileInfos, newFileInfo(dbFile))
+		totalSize += f.size
 	}
 
-	res.StorageID = storageID
-	res.Files = fileInfos
-	res.TotalSize = totalSize
-	res.Success = true
-	return res, nil
+	return fileInfos, totalSize, nil
 }
 
-func (s *localFileService) DownloadFile(ctx context.Context, storageID, stringID string) (*filemanager.DownloadResult, error) {
+// noFilesError explains why an upload ended up storing nothing
+func noFilesError(rejected []filemanager.RejectedFile) error {
+	if len(rejected) == 0 {
+		return errors.New("no files provided")
+	}
+	return fmt.Errorf("%w: every file was rejected", ErrContentDigestMismatch)
+}
+
+// discardStaged gives back the blob references of staged files that will never get a files row
+func (s *localFileService) discardStaged(ctx context.Context, staged []stagedFile) {
+	for _, f := range staged {
+		s.releaseBlob(ctx, f.s3Key)
+	}
+}
+
+func (s *localFileService) DownloadFile(ctx context.Context, storageID, stringID string, opts DownloadOptions) (*filemanager.DownloadResult, error) {
 	if storageID == "" || stringID == "" {
 		return nil, errors.New("storage id and string id are required")
 	}
@@ -243,24 +491,134 @@ func (s *localFileService) DownloadFile(ctx context.Context, storageID, stringID
 		return nil, errors.New("filemanager connection not configured")
 	}
 
-	// Extract just the filename part from s3_key for the download
-	// s3_key format: "bucket_id/string_id"
-	parts := strings.Split(file.S3Key, "/")
-	if len(parts) != 2 {
-		return nil, errors.New("invalid s3_key format")
+	// The object may live under a shared blob prefix rather than the bucket's own
+	objectStorageID, objectName, err := splitS3Key(file.S3Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse exhausted files before touching S3; the atomic check below still decides races
+	if file.MaxDownloads != nil && file.DownloadCount >= *file.MaxDownloads {
+		return nil, ErrDownloadLimitReached
+	}
+
+	inline := opts.Inline && inlineAllowed(file.ContentType)
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+
+	// Link previews and `curl -I` send HEAD; they get the headers of a full download and use up nothing
+	if opts.Head {
+		head := &filemanager.DownloadResult{
+			ContentType:    file.ContentType,
+			ContentLength:  file.Size,
+			DownloadedFile: file.OriginalName,
+			AcceptRanges:   file.MaxDownloads == nil,
+			LastModified:   file.CreatedAt,
+			Inline:         inline,
+		}
+		if file.SHA256 != nil {
+			head.SHA256 = *file.SHA256
+		}
+		return head, nil
 	}
 
-	downloadResult, err := fm.Download(ctx, storageID, parts[1])
+	// Files without a download limit may be served by S3 directly. Limited files stay proxied:
+	// a presigned URL can be reused until it expires, and burning has to see the stream end.
+	if s.redirectDownloads && file.MaxDownloads == nil {
+		url, err := fm.PresignDownload(ctx, objectStorageID, objectName, filemanager.PresignOptions{
+			ContentDisposition: ContentDisposition(disposition, file.OriginalName),
+			ContentType:        file.ContentType,
+			Expiry:             s.redirectExpiry,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, ok, err := s.consumeDownload(file, opts.ShareLinkID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrDownloadLimitReached
+		}
+		return &filemanager.DownloadResult{
+			ContentType:    file.ContentType,
+			DownloadedFile: file.OriginalName,
+			RedirectURL:    url,
+			Inline:         inline,
+		}, nil
+	}
+
+	// Ranges are only served for files without a download limit,
+	// otherwise every seek or resumed chunk would count as a download
+	var downloadResult *filemanager.DownloadResult
+	if file.MaxDownloads == nil && opts.Range != "" && ifRangeMatches(opts.IfRange, file.CreatedAt, file.SHA256) {
+		start, end, ok, err := parseByteRange(opts.Range, file.Size)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			downloadResult, err = fm.DownloadRange(ctx, objectStorageID, objectName, start, end)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if downloadResult == nil {
+		downloadResult, err = fm.Download(ctx, objectStorageID, objectName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	downloadResult.LastModified = file.CreatedAt
+	downloadResult.ContentType = file.ContentType // A shared blob carries the type of its first upload
+	downloadResult.Inline = inline
+	if file.SHA256 != nil {
+		downloadResult.SHA256 = *file.SHA256
+	}
+	if file.MaxDownloads != nil {
+		downloadResult.AcceptRanges = false
+	}
+
+	// Partial responses are pieces of a download that is already underway, so they are not counted
+	if downloadResult.ContentRange != "" {
+		downloadResult.DownloadedFile = file.OriginalName
+		return downloadResult, nil
+	}
+
+	count, ok, err := s.consumeDownload(file, opts.ShareLinkID)
 	if err != nil {
+		downloadResult.Body.Close()
 		return nil, err
 	}
+	if !ok {
+		downloadResult.Body.Close()
+		return nil, ErrDownloadLimitReached
+	}
+
+	// The last allowed download of a burn-after-reading bucket deletes the file once streamed
+	if file.MaxDownloads != nil && count >= *file.MaxDownloads {
+		bucket, err := s.fileRepo.GetBucketByID(storageID)
+		if err != nil {
+			downloadResult.Body.Close()
+			return nil, err
+		}
+		if bucket != nil && bucket.BurnAfterReading {
+			downloadResult.Body = &burnOnClose{
+				ReadCloser: downloadResult.Body,
+				size:       downloadResult.ContentLength,
+				burn:       func() { s.burnFile(file) },
+			}
+		}
+	}
 
 	// Override the downloaded filename with the original name from DB
 	downloadResult.DownloadedFile = file.OriginalName
 	return downloadResult, nil
 }
 
-func (s *localFileService) RetrieveFileBucket(ctx context.Context, storageID string) (*filemanager.BucketMetadata, error) {
+func (s *localFileService) RetrieveFileBucket(ctx context.Context, storageID string, opts BucketListingOptions) (*filemanager.BucketMetadata, error) {
 	if storageID == "" {
 		return nil, errors.New("storage id is required")
 	}
@@ -271,7 +629,10 @@ func (s *localFileService) RetrieveFileBucket(ctx context.Context, storageID str
 		return nil, err
 	}
 	if bucket == nil {
-		return nil, errors.New("bucket not found")
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
 	}
 
 	// Query DB for files in bucket
@@ -284,42 +645,62 @@ func (s *localFileService) RetrieveFileBucket(ctx context.Context, storageID str
 	files := make([]filemanager.FileInfo, 0, len(dbFiles))
 	var totalSize int64
 
+	prefix := strings.TrimPrefix(opts.Prefix, "/")
 	for _, dbFile := range dbFiles {
-		files = append(files, filemanager.FileInfo{
-			OriginalName: dbFile.OriginalName,
-			StringID:     dbFile.StringID,
-			Key:          dbFile.S3Key,
-			Size:         dbFile.Size,
-			ContentType:  dbFile.ContentType,
-		})
+		if !strings.HasPrefix(filePath(dbFile), prefix) {
+			continue
+		}
+		files = append(files, newFileInfo(dbFile))
 		totalSize += dbFile.Size
 	}
 
+	var tree *filemanager.FolderNode
+	if opts.Tree {
+		tree = buildFolderTree(files)
+	}
+
+	labels := bucket.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
 	return &filemanager.BucketMetadata{
-		StorageID: storageID,
-		Files:     files,
-		TotalSize: totalSize,
+		StorageID:   storageID,
+		Title:       bucket.Title,
+		Description: bucket.Description,
+		Labels:      labels,
+		Files:       files,
+		Tree:        tree,
+		TotalSize:   totalSize,
+		ExpiresAt:   bucket.ExpiresAt,
 	}, nil
 }
 
-func (s *localFileService) IsBucketProtected(ctx context.Context, bucketID string) (bool, *string, error) {
+// IsBucketProtected reports whether a bucket needs a password, and the version of that password
+// its access tokens must carry
+func (s *localFileService) IsBucketProtected(ctx context.Context, bucketID string) (bool, int64, error) {
 	if bucketID == "" {
-		return false, nil, errors.New("bucket id is required")
+		return false, 0, errors.New("bucket id is required")
 	}
 
 	bucket, err := s.fileRepo.GetBucketByID(bucketID)
 	if err != nil {
-		return false, nil, err
+		return false, 0, err
 	}
 	if bucket == nil {
-		return false, nil, errors.New("bucket not found")
+		return false, 0, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return false, 0, ErrBucketExpired
 	}
 
 	isProtected := bucket.PasswordHash != nil && *bucket.PasswordHash != ""
-	return isProtected, bucket.PasswordHash, nil
+	return isProtected, bucket.PasswordVersion, nil
 }
 
-func (s *localFileService) AuthenticateBucket(ctx context.Context, bucketID, password string, userID *string, authTokenID *string) (string, error) {
+// AuthenticateBucket exchanges a bucket password for an access token. Failed attempts are counted
+// per bucket and per clientIP, and lock both out with exponential backoff.
+func (s *localFileService) AuthenticateBucket(ctx context.Context, bucketID, password, clientIP string, userID *string, authTokenID *string) (string, error) {
 	if bucketID == "" {
 		return "", errors.New("bucket id is required")
 	}
@@ -333,7 +714,10 @@ func (s *localFileService) AuthenticateBucket(ctx context.Context, bucketID, pas
 		return "", err
 	}
 	if bucket == nil {
-		return "", errors.New("bucket not found")
+		return "", ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return "", ErrBucketExpired
 	}
 
 	// Check if bucket is protected
@@ -341,19 +725,100 @@ func (s *localFileService) AuthenticateBucket(ctx context.Context, bucketID, pas
 		return "", errors.New("bucket is not protected")
 	}
 
+	// Locked out attempts are refused before paying for Argon2
+	if err := s.checkPasswordAttempt(bucketID, clientIP); err != nil {
+		return "", err
+	}
+
 	// Verify password
-	if !VerifyPassword(password, *bucket.PasswordHash) {
+	release, err := s.acquirePasswordCheck(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Attempts queued for a slot were all let through by the check above; those whose
+	// bucket or IP got locked out while they waited are refused before running Argon2
+	if err := s.checkPasswordAttempt(bucketID, clientIP); err != nil {
+		release()
+		return "", err
+	}
+	valid := VerifyPassword(password, *bucket.PasswordHash)
+	release()
+	if !valid {
+		s.recordPasswordFailure(bucketID, clientIP)
 		return "", errors.New("invalid password")
 	}
+	s.clearPasswordFailures(clientIP)
 
-	// Generate bucket access token with read privileges
-	privileges := []string{"read"}
-	token, err := GenerateBucketAccessToken(bucketID, userID, authTokenID, privileges)
+	// The password lets anyone read; the bucket's own admins get every privilege
+	privileges := []string{PrivilegeRead}
+	if userID != nil && *userID != "" {
+		isAdmin, err := s.fileRepo.IsBucketAdmin(*userID, bucketID)
+		if err != nil {
+			return "", err
+		}
+		if isAdmin {
+			privileges = []string{PrivilegeAdmin}
+		}
+	}
+	return s.issueBucketAccessToken(bucket, userID, authTokenID, privileges)
+}
+
+// MintBucketAccessToken lets a bucket admin issue an access token limited to privileges,
+// to hand to someone who should not get the password. It can grant read, write and delete, which the
+// file routes accept in place of a logged-in bucket admin; admin stays with the bucket's admins.
+func (s *localFileService) MintBucketAccessToken(ctx context.Context, bucketID, userID string, privileges []string) (*BucketAccessTokenResponse, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate bucket access token: %w", err)
+		return nil, err
 	}
 
-	return token, nil
+	privileges, err = ParsePrivileges(privileges)
+	if err != nil {
+		return nil, err
+	}
+	for _, privilege := range privileges {
+		if privilege == PrivilegeAdmin {
+			return nil, fmt.Errorf("minted tokens cannot grant the %s privilege; it is kept for bucket admins", PrivilegeAdmin)
+		}
+	}
+
+	token, err := s.issueBucketAccessToken(bucket, nil, nil, privileges)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BucketAccessTokenResponse{
+		AccessToken: token,
+		ExpiresIn:   int(bucketTokenExpiry.Seconds()),
+		Privileges:  privileges,
+	}, nil
+}
+
+// SetBucketPassword lets a bucket admin change the bucket's password, or remove it when password is nil.
+// Either way every access token issued for the old password stops working.
+func (s *localFileService) SetBucketPassword(ctx context.Context, bucketID, userID string, password *string) error {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
+	if err != nil {
+		return err
+	}
+
+	var passwordHash *string
+	if password == nil {
+		if bucket.PasswordHash == nil || *bucket.PasswordHash == "" {
+			return errors.New("bucket is not protected")
+		}
+	} else {
+		if *password == "" {
+			return errors.New("password is required")
+		}
+		hash, err := HashPassword(*password)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		passwordHash = &hash
+	}
+
+	return s.fileRepo.SetBucketPassword(bucket.ID, passwordHash, time.Now().Unix())
 }
 
 func (s *localFileService) GetBucketAdmins(ctx context.Context, bucketID string) (*BucketAdminsResponse, error) {
@@ -367,7 +832,7 @@ func (s *localFileService) GetBucketAdmins(ctx context.Context, bucketID string)
 		return nil, err
 	}
 	if bucket == nil {
-		return nil, errors.New("bucket not found")
+		return nil, ErrBucketNotFound
 	}
 
 	// Get all admins for the bucket
@@ -384,35 +849,12 @@ func (s *localFileService) GetBucketAdmins(ctx context.Context, bucketID string)
 		}, nil
 	}
 
-	// Determine owner: first admin by created_at (oldest)
-	var ownerAdmin *local.BucketAdmin
-	if len(admins) > 0 {
-		ownerAdmin = admins[0]
-		for _, admin := range admins[1:] {
-			if admin.CreatedAt < ownerAdmin.CreatedAt {
-				ownerAdmin = admin
-			}
-		}
-	}
-
 	// Access auth repository to get user details
-	authConn := s.conns.Authentication
-	if authConn == nil {
-		return nil, errors.New("authentication connection not configured")
-	}
-
-	// Type assert to local connection to access GetRepo
-	type repoGetter interface {
-		GetRepo() local.AuthRepository
-	}
-
-	localAuthConn, ok := authConn.(repoGetter)
-	if !ok {
-		return nil, errors.New("authentication connection does not support repository access")
+	authRepo, err := s.authRepo()
+	if err != nil {
+		return nil, err
 	}
 
-	authRepo := localAuthConn.GetRepo()
-
 	// Build admin info list with user details
 	adminInfos := make([]AdminInfo, 0, len(admins))
 	var ownerInfo *AdminInfo
@@ -428,7 +870,7 @@ func (s *localFileService) GetBucketAdmins(ctx context.Context, bucketID string)
 			continue
 		}
 
-		isOwner := ownerAdmin != nil && admin.UserID == ownerAdmin.UserID && admin.CreatedAt == ownerAdmin.CreatedAt
+		isOwner := bucket.OwnerID != nil && admin.UserID == *bucket.OwnerID
 
 		adminInfo := AdminInfo{
 			UserID:    admin.UserID,
@@ -453,6 +895,316 @@ func (s *localFileService) GetBucketAdmins(ctx context.Context, bucketID string)
 	}, nil
 }
 
+func (s *localFileService) DeleteBucket(ctx context.Context, bucketID, userID string) error {
+	if bucketID == "" {
+		return errors.New("bucket id is required")
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return ErrBucketNotFound
+	}
+
+	if err := s.requireBucketAdmin(bucketID, userID); err != nil {
+		return err
+	}
+
+	return s.purgeBucket(ctx, bucketID)
+}
+
+func (s *localFileService) DeleteFile(ctx context.Context, bucketID, stringID string, access BucketAccess) error {
+	if bucketID == "" || stringID == "" {
+		return errors.New("storage id and string id are required")
+	}
+
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.requireBucketPrivilege(bucketID, access, PrivilegeDelete); err != nil {
+		return err
+	}
+
+	return s.removeFile(ctx, file)
+}
+
+func (s *localFileService) ReplaceFile(ctx context.Context, bucketID, stringID string, access BucketAccess, src UploadSource) (*filemanager.FileInfo, error) {
+	if bucketID == "" || stringID == "" {
+		return nil, errors.New("storage id and string id are required")
+	}
+
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.requireBucketPrivilege(bucketID, access, PrivilegeWrite); err != nil {
+		return nil, err
+	}
+
+	// The new content counts against the file's owner, who gets the old size back;
+	// a file without an owner is charged like a file added to the bucket
+	var quota *uploadQuota
+	if file.OwnerID != nil {
+		quota, err = s.reserveQuota(file.OwnerID, "", false, file.Size)
+	} else {
+		var bucket *local.Bucket
+		if bucket, err = s.fileRepo.GetBucketByID(bucketID); err != nil {
+			return nil, err
+		}
+		if bucket == nil {
+			return nil, ErrBucketNotFound
+		}
+		ownerID, clientIP := bucketPayer(bucket, access)
+		quota, err = s.reserveQuota(ownerID, clientIP, false, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return nil, errors.New("filemanager connection not configured")
+	}
+
+	oldStorageID, oldObjectName, err := splitS3Key(file.S3Key)
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := src.NextFile()
+	if err == io.EOF {
+		return nil, errors.New("no file provided")
+	}
+	if err != nil {
+		return nil, err
+	}
+	expected, err := parseContentSHA256(part.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// New bytes get a new string_id so cached links to the old content stop resolving
+	newStringID := s.generateUniqueStringID(ctx)
+	if newStringID == "" {
+		return nil, errors.New("failed to generate unique string_id")
+	}
+
+	detected, body, err := sniffContentType(part.Name, part.ContentType, quota.limit(part.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := s.storeBlob(ctx, fm, detected.contentType, body, expected)
+	if quotaErr := quota.exceeded(); quotaErr != nil {
+		return nil, quotaErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A file is replaced by exactly one new file
+	if _, err := src.NextFile(); err != io.EOF {
+		s.releaseBlob(ctx, blob.s3Key)
+		if err == nil {
+			err = errors.New("only one file may be provided")
+		}
+		return nil, err
+	}
+
+	oldS3Key := file.S3Key
+	file.StringID = newStringID
+	file.Size = blob.size
+	detected.apply(file)
+	file.S3Key = blob.s3Key
+	file.SHA256 = &blob.sha256
+	file.CreatedAt = time.Now().Unix()
+	file.DownloadCount = 0 // New content starts with its full download allowance
+	if err := s.fileRepo.UpdateFile(file); err != nil {
+		// Row still points at the old content, so give the new one back
+		s.releaseBlob(ctx, blob.s3Key)
+		return nil, err
+	}
+
+	// The row no longer references the old content; a failed delete only leaves an orphan behind
+	deleteThumbnails(ctx, fm, bucketID, stringID)
+	if isBlobKey(oldS3Key) {
+		s.releaseBlob(ctx, oldS3Key)
+	} else {
+		_ = fm.Delete(ctx, oldStorageID, oldObjectName)
+	}
+
+	info := newFileInfo(file)
+	return &info, nil
+}
+
+// PurgeExpiredBuckets deletes every bucket whose expiry has passed and returns how many were removed.
+// A bucket that fails to purge is skipped so the rest still go; the first error is returned.
+func (s *localFileService) PurgeExpiredBuckets(ctx context.Context) (int, error) {
+	buckets, err := s.fileRepo.GetExpiredBuckets(time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	var firstErr error
+	for _, bucket := range buckets {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		if err := s.purgeBucket(ctx, bucket.ID); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to purge bucket %s: %w", bucket.ID, err)
+			}
+			continue
+		}
+		purged++
+	}
+
+	// Records of expired access tokens are no longer needed to reject them
+	now := time.Now()
+	if _, err := s.fileRepo.DeleteExpiredBucketTokens(now.Unix()); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to delete expired bucket tokens: %w", err)
+	}
+	if _, err := s.fileRepo.DeleteStaleAuthFailures(now.Add(-authFailureWindow).Unix(), now.Unix()); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to delete stale password failures: %w", err)
+	}
+
+	return purged, firstErr
+}
+
+// getBucketFile looks up a file by string_id and makes sure it belongs to bucketID
+func (s *localFileService) getBucketFile(bucketID, stringID string) (*local.File, error) {
+	file, err := s.fileRepo.GetFileByStringID(stringID)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.BucketID != bucketID {
+		return nil, ErrFileNotFound
+	}
+	return file, nil
+}
+
+// removeFile deletes a file's S3 object and then its row
+func (s *localFileService) removeFile(ctx context.Context, file *local.File) error {
+	fm := s.filemanager()
+	if fm == nil {
+		return errors.New("filemanager connection not configured")
+	}
+
+	deleteThumbnails(ctx, fm, file.BucketID, file.StringID)
+
+	// Shared content is released with the row and only deleted once no other file uses it
+	if isBlobKey(file.S3Key) {
+		if err := s.fileRepo.DeleteFile(file.ID); err != nil {
+			return err
+		}
+		s.purgeUnreferencedBlobs(ctx)
+		return nil
+	}
+
+	storageID, objectName, err := splitS3Key(file.S3Key)
+	if err != nil {
+		return err
+	}
+	if err := fm.Delete(ctx, storageID, objectName); err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return s.fileRepo.DeleteFile(file.ID)
+}
+
+// burnFile removes a file whose last allowed download finished, and its bucket once no files remain.
+// It runs after the request is over, so it uses its own context and only logs failures.
+func (s *localFileService) burnFile(file *local.File) {
+	ctx := context.Background()
+
+	if err := s.removeFile(ctx, file); err != nil {
+		slog.Error("failed to burn file", "bucket_id", file.BucketID, "string_id", file.StringID, "error", err)
+		return
+	}
+
+	remaining, err := s.fileRepo.GetFilesByBucketID(file.BucketID)
+	if err != nil {
+		slog.Error("failed to list burned bucket", "bucket_id", file.BucketID, "error", err)
+		return
+	}
+	if len(remaining) == 0 {
+		if err := s.purgeBucket(ctx, file.BucketID); err != nil {
+			slog.Error("failed to burn bucket", "bucket_id", file.BucketID, "error", err)
+		}
+	}
+}
+
+// requireBucketAdmin returns ErrNotBucketAdmin unless userID administers the bucket
+func (s *localFileService) requireBucketAdmin(bucketID, userID string) error {
+	if userID == "" {
+		return ErrNotBucketAdmin
+	}
+
+	isAdmin, err := s.fileRepo.IsBucketAdmin(userID, bucketID)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return ErrNotBucketAdmin
+	}
+
+	return nil
+}
+
+// requireBucketPrivilege lets access act on a bucket with privilege: either through a bucket access
+// token for the bucket granting it, or as a logged-in admin of the bucket
+func (s *localFileService) requireBucketPrivilege(bucketID string, access BucketAccess, privilege string) error {
+	if access.Claims != nil && access.Claims.BucketID == bucketID && access.Claims.Allows(privilege) {
+		return nil
+	}
+	return s.requireBucketAdmin(bucketID, access.UserID)
+}
+
+// bucketPayer returns who is charged for files access adds to a bucket, and owns them:
+// the logged-in user, or for a token holder who is not logged in, whoever the bucket itself is charged to
+func bucketPayer(bucket *local.Bucket, access BucketAccess) (ownerID *string, clientIP string) {
+	if access.UserID != "" {
+		return &access.UserID, ""
+	}
+	if bucket.OwnerID != nil {
+		return bucket.OwnerID, ""
+	}
+	if bucket.UploaderIP != nil {
+		return nil, *bucket.UploaderIP
+	}
+	return nil, ""
+}
+
+// purgeBucket removes every S3 object of a bucket, then its DB row.
+// Objects go first so a failed S3 call leaves the bucket in place to retry;
+// files and bucket_admins rows cascade from the bucket row. Shared blobs live outside the
+// bucket's prefix and are only deleted once the cascade has released their last reference.
+func (s *localFileService) purgeBucket(ctx context.Context, bucketID string) error {
+	fm := s.filemanager()
+	if fm == nil {
+		return errors.New("filemanager connection not configured")
+	}
+
+	if err := fm.DeleteStorage(ctx, bucketID); err != nil {
+		return fmt.Errorf("failed to delete bucket objects: %w", err)
+	}
+	if err := fm.DeleteStorage(ctx, thumbnailStorageID(bucketID)); err != nil {
+		return fmt.Errorf("failed to delete bucket thumbnails: %w", err)
+	}
+
+	if err := s.fileRepo.DeleteBucket(bucketID); err != nil {
+		return err
+	}
+	s.purgeUnreferencedBlobs(ctx)
+	return nil
+}
+
 func (s *localFileService) filemanager() filemanager.FilemanagerConnection {
 	if s == nil || s.conns == nil {
 		return nil
@@ -460,6 +1212,97 @@ func (s *localFileService) filemanager() filemanager.FilemanagerConnection {
 	return s.conns.Filemanager
 }
 
+// validOwner returns userID when it names an existing user, otherwise nil
+func (s *localFileService) validOwner(userID *string) *string {
+	if userID == nil || *userID == "" {
+		return nil
+	}
+	authConn := s.conns.Authentication
+	if authConn == nil {
+		return nil
+	}
+	valid, err := authConn.ValidateUserID(*userID)
+	if err != nil || !valid {
+		return nil
+	}
+	return userID
+}
+
+// checkUploadOptions validates the bucket settings of a new upload against the resolved per-file limits
+func checkUploadOptions(opts UploadOptions, limits []*int64, now int64) error {
+	if opts.ExpiresAt != nil && *opts.ExpiresAt <= now {
+		return errors.New("expiry must be in the future")
+	}
+	if opts.BurnAfterReading && !hasDownloadLimit(limits) {
+		return errors.New("burn_after_reading requires a download limit")
+	}
+	if _, _, _, err := normalizeBucketDetails(opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newFileInfo converts a files row into its API representation
+func newFileInfo(file *local.File) filemanager.FileInfo {
+	info := filemanager.FileInfo{
+		OriginalName: file.OriginalName,
+		Path:         file.Path,
+		StringID:     file.StringID,
+		Key:          file.S3Key,
+		Size:         file.Size,
+		ContentType:  file.ContentType,
+
+		ContentTypeMismatch: file.ContentTypeMismatch,
+	}
+	if file.SHA256 != nil {
+		info.SHA256 = *file.SHA256
+	}
+	if file.DeclaredContentType != nil {
+		info.DeclaredContentType = *file.DeclaredContentType
+	}
+	if file.MaxDownloads != nil {
+		remaining := max(*file.MaxDownloads-file.DownloadCount, 0)
+		info.RemainingDownloads = &remaining
+	}
+	return info
+}
+
+// resolveDownloadLimits returns the download limit of each of n files:
+// its own entry in perFile when set, otherwise the bucket default
+func resolveDownloadLimits(n int, bucketDefault *int64, perFile []*int64) []*int64 {
+	limits := make([]*int64, n)
+	for i := range limits {
+		limits[i] = bucketDefault
+		if i < len(perFile) && perFile[i] != nil {
+			limits[i] = perFile[i]
+		}
+	}
+	return limits
+}
+
+func hasDownloadLimit(limits []*int64) bool {
+	for _, limit := range limits {
+		if limit != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketExpired reports whether a bucket's expiry has passed; the reaper may not have removed it yet
+func bucketExpired(bucket *local.Bucket, now time.Time) bool {
+	return bucket.ExpiresAt != nil && *bucket.ExpiresAt <= now.Unix()
+}
+
+// splitS3Key splits an s3_key of the form "bucket_id/string_id" or "blobs/<uuid>" into its parts
+func splitS3Key(key string) (string, string, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 {
+		return "", "", errors.New("invalid s3_key format")
+	}
+	return parts[0], parts[1], nil
+}
+
 // generateStorageID generates a 10-character alphanumeric storage ID
 func (s *localFileService) generateStorageID() string {
 	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
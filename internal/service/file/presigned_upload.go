@@ -0,0 +1,433 @@
+package file
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxPresignedUploadSize is the largest object S3 accepts in a single PutObject
+	maxPresignedUploadSize = 5 << 30
+	// maxPresignedUploadFiles caps how many files one upload session may declare
+	maxPresignedUploadFiles = 1000
+)
+
+// DeclaredFile is a file the client intends to PUT straight to S3
+type DeclaredFile struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	SHA256       string `json:"sha256"`                  // Hex SHA-256 of the content; S3 refuses a PUT of other bytes
+	MaxDownloads *int64 `json:"max_downloads,omitempty"` // nil = bucket default
+}
+
+// PresignedFileUpload tells the client where and how to upload one declared file
+type PresignedFileUpload struct {
+	OriginalName string            `json:"original_name"`
+	StringID     string            `json:"string_id"`
+	URL          string            `json:"upload_url"`
+	Method       string            `json:"method"`
+	Headers      map[string]string `json:"headers"` // Signed headers the PUT must carry
+}
+
+// PresignedUpload is returned when an upload session starts.
+// UploadToken is required to complete the session and is never stored in plain text.
+type PresignedUpload struct {
+	StorageID       string                `json:"storage_id"`
+	UploadToken     string                `json:"upload_token"`
+	ExpiresAt       int64                 `json:"expires_at"`                  // Session deadline for the complete step
+	BucketExpiresAt *int64                `json:"bucket_expires_at,omitempty"` // Bucket expiry chosen by the uploader
+	Files           []PresignedFileUpload `json:"files"`
+}
+
+// InitiateUpload creates a bucket and returns one presigned PutObject URL per declared file.
+// Each URL signs the file's declared SHA-256, so S3 itself refuses a PUT of any other content.
+// The files only become visible once CompleteUpload has checked that every object exists.
+func (s *localFileService) InitiateUpload(ctx context.Context, files []DeclaredFile, userID *string, clientIP string, opts UploadOptions) (*PresignedUpload, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files provided")
+	}
+	if len(files) > maxPresignedUploadFiles {
+		return nil, fmt.Errorf("at most %d files can be uploaded at once", maxPresignedUploadFiles)
+	}
+	for i := range files {
+		files[i].Name = strings.TrimSpace(files[i].Name)
+		if files[i].Name == "" {
+			return nil, errors.New("every file needs a name")
+		}
+		if _, _, err := splitFilePath(files[i].Name); err != nil {
+			return nil, err
+		}
+		if files[i].Size < 0 || files[i].Size > maxPresignedUploadSize {
+			return nil, fmt.Errorf("%s: size must be between 0 and %d bytes", files[i].Name, int64(maxPresignedUploadSize))
+		}
+		if files[i].MaxDownloads != nil && *files[i].MaxDownloads <= 0 {
+			return nil, fmt.Errorf("%s: max_downloads must be a positive integer", files[i].Name)
+		}
+		if files[i].ContentType == "" {
+			files[i].ContentType = "application/octet-stream"
+		}
+		files[i].SHA256 = strings.ToLower(strings.TrimSpace(files[i].SHA256))
+		if digest, err := hex.DecodeString(files[i].SHA256); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%s: sha256 must be the hex SHA-256 of the file", files[i].Name)
+		}
+	}
+
+	now := time.Now()
+	perFile := make([]*int64, len(files))
+	for i, f := range files {
+		perFile[i] = f.MaxDownloads
+	}
+	limits := resolveDownloadLimits(len(files), opts.DefaultMaxDownloads, perFile)
+	if err := checkUploadOptions(opts, limits, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	// Declared sizes are charged up front; S3 rejects a PUT whose body differs from its signed length
+	quota, err := s.reserveQuota(userID, clientIP, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := quota.reserve(f.Size); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, f.Name)
+		}
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return nil, errors.New("filemanager connection not configured")
+	}
+
+	token, err := generateUploadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	storageID, err := s.reserveStorageID()
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := s.createBucket(storageID, userID, clientIP, opts, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := make([]PresignedFileUpload, 0, len(files))
+	pending := make([]*local.PendingFile, 0, len(files))
+	for i, f := range files {
+		stringID := uuid.New().String()
+		checksum := base64SHA256(f.SHA256)
+		url, err := fm.PresignUpload(ctx, bucket.ID, stringID, filemanager.PresignUploadOptions{
+			ContentType:    f.ContentType,
+			ContentLength:  f.Size,
+			ChecksumSHA256: checksum,
+			Expiry:         s.presignUploadExpiry,
+		})
+		if err != nil {
+			s.discardBucket(bucket.ID)
+			return nil, err
+		}
+
+		uploads = append(uploads, PresignedFileUpload{
+			OriginalName: f.Name,
+			StringID:     stringID,
+			URL:          url,
+			Method:       http.MethodPut,
+			Headers:      map[string]string{"Content-Type": f.ContentType, "x-amz-checksum-sha256": checksum},
+		})
+		pending = append(pending, &local.PendingFile{
+			StringID:     stringID,
+			BucketID:     bucket.ID,
+			OriginalName: f.Name,
+			Size:         f.Size,
+			ContentType:  f.ContentType,
+			SHA256:       f.SHA256,
+			S3Key:        bucket.ID + "/" + stringID,
+			MaxDownloads: limits[i],
+			CreatedAt:    now.Unix(),
+		})
+	}
+
+	// Completion stays open for a second expiry window, so a PUT started just before
+	// its URL lapsed can still finish and be finalized
+	session := &local.UploadSession{
+		BucketID:  bucket.ID,
+		TokenHash: hashUploadToken(token),
+		OwnerID:   s.validOwner(userID),
+		ExpiresAt: now.Add(2 * s.presignUploadExpiry).Unix(),
+		CreatedAt: now.Unix(),
+	}
+	if err := s.fileRepo.CreateUploadSession(session, pending); err != nil {
+		s.discardBucket(bucket.ID)
+		return nil, err
+	}
+
+	return &PresignedUpload{
+		StorageID:       bucket.ID,
+		UploadToken:     token,
+		ExpiresAt:       session.ExpiresAt,
+		BucketExpiresAt: bucket.ExpiresAt,
+		Files:           uploads,
+	}, nil
+}
+
+// CompleteUpload checks every declared object with HeadObject and turns the session into files rows.
+// Nothing is finalized until all objects are present, so the client can retry after finishing its PUTs.
+// Each object is then copied into a blob inside S3; the gateway only reads enough of it to sniff its type.
+func (s *localFileService) CompleteUpload(ctx context.Context, bucketID, uploadToken string) (*filemanager.UploadResult, error) {
+	if bucketID == "" {
+		return nil, errors.New("bucket id is required")
+	}
+
+	session, err := s.fileRepo.GetUploadSession(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrUploadSessionNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(hashUploadToken(uploadToken)), []byte(session.TokenHash)) != 1 {
+		return nil, ErrInvalidUploadToken
+	}
+	if session.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrUploadSessionExpired
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	if bucketExpired(bucket, time.Now()) {
+		return nil, ErrBucketExpired
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return nil, errors.New("filemanager connection not configured")
+	}
+
+	pending, err := s.fileRepo.GetPendingFilesByBucketID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]string, 0)
+	for _, p := range pending {
+		info, err := fm.Head(ctx, bucketID, p.StringID)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			missing = append(missing, p.OriginalName)
+			continue
+		}
+		if info.Size != p.Size {
+			return nil, fmt.Errorf("%w: %s is %d bytes, declared %d", ErrUploadIncomplete, p.OriginalName, info.Size, p.Size)
+		}
+		// S3 only stores the checksum it verified the PUT against
+		if p.SHA256 == "" || info.ChecksumSHA256 != base64SHA256(p.SHA256) {
+			return nil, fmt.Errorf("%w: %s was not uploaded with its declared sha256", ErrUploadIncomplete, p.OriginalName)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: not uploaded yet: %s", ErrUploadIncomplete, strings.Join(missing, ", "))
+	}
+
+	res := &filemanager.UploadResult{
+		TransactionID: uuid.New().String(),
+		Success:       false,
+	}
+
+	fileInfos := make([]filemanager.FileInfo, 0, len(pending))
+	totalSize := int64(0)
+	for _, p := range pending {
+		// A retried completion skips files an earlier attempt already created
+		dbFile, err := s.fileRepo.GetFileByStringID(p.StringID)
+		if err != nil {
+			res.Error = err.Error()
+			return res, err
+		}
+		if dbFile == nil {
+			dbFile, err = s.finalizePendingFile(ctx, fm, p, session.OwnerID)
+			if err != nil {
+				res.Error = err.Error()
+				return res, err
+			}
+		}
+
+		fileInfos = append(fileInfos, newFileInfo(dbFile))
+		totalSize += dbFile.Size
+	}
+
+	if err := s.fileRepo.DeleteUploadSession(bucketID); err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+
+	res.StorageID = bucketID
+	res.Files = fileInfos
+	res.TotalSize = totalSize
+	res.ExpiresAt = bucket.ExpiresAt
+	res.Success = true
+	return res, nil
+}
+
+// finalizePendingFile copies an object the client put through a presigned URL into a shared blob and
+// records the file against it like any other upload, so content already stored elsewhere is deduplicated.
+// The copy happens inside S3 and the digest is the one S3 checked the PUT against, so only the first
+// bytes are fetched, to sniff the content type. The URL stays valid after completion, but its signed
+// checksum means the object behind it can only be put again with the same bytes.
+func (s *localFileService) finalizePendingFile(ctx context.Context, fm filemanager.FilemanagerConnection, p *local.PendingFile, ownerID *string) (*local.File, error) {
+	folder, name, err := splitFilePath(p.OriginalName)
+	if err != nil {
+		return nil, err
+	}
+
+	var head []byte
+	if p.Size > 0 {
+		object, err := fm.DownloadRange(ctx, p.BucketID, p.StringID, 0, min(p.Size, sniffLength)-1)
+		if err != nil {
+			return nil, err
+		}
+		head, err = io.ReadAll(io.LimitReader(object.Body, sniffLength))
+		object.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	detected := detectContentType(p.OriginalName, p.ContentType, head)
+
+	blob, err := s.copyBlob(ctx, fm, p.BucketID, p.StringID, detected.contentType, p.Size, p.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	dbFile := &local.File{
+		StringID:     p.StringID,
+		BucketID:     p.BucketID,
+		OriginalName: name,
+		Path:         folder,
+		OwnerID:      ownerID,
+		Size:         blob.size,
+		S3Key:        blob.s3Key,
+		CreatedAt:    time.Now().Unix(),
+		MaxDownloads: p.MaxDownloads,
+		SHA256:       &blob.sha256,
+	}
+	detected.apply(dbFile)
+	if err := s.fileRepo.CreateFile(dbFile); err != nil {
+		s.releaseBlob(ctx, blob.s3Key)
+		return nil, err
+	}
+
+	if err := fm.Delete(ctx, p.BucketID, p.StringID); err != nil {
+		slog.Error("failed to delete presigned upload object", "bucket_id", p.BucketID, "string_id", p.StringID, "error", err)
+	}
+	return dbFile, nil
+}
+
+// PurgeStaleUploads removes upload sessions that were never completed and tus uploads left idle.
+// A bucket that holds no finalized files is purged with its session; otherwise only the pending objects go.
+func (s *localFileService) PurgeStaleUploads(ctx context.Context) (int, error) {
+	sessions, err := s.fileRepo.GetExpiredUploadSessions(time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return 0, errors.New("filemanager connection not configured")
+	}
+
+	purged := 0
+	var firstErr error
+	for _, session := range sessions {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		if err := s.purgeUploadSession(ctx, fm, session.BucketID); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to purge upload session %s: %w", session.BucketID, err)
+			}
+			continue
+		}
+		purged++
+	}
+
+	tusPurged, err := s.purgeStaleTusUploads(ctx)
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return purged + tusPurged, firstErr
+}
+
+func (s *localFileService) purgeUploadSession(ctx context.Context, fm filemanager.FilemanagerConnection, bucketID string) error {
+	files, err := s.fileRepo.GetFilesByBucketID(bucketID)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return s.purgeBucket(ctx, bucketID)
+	}
+
+	pending, err := s.fileRepo.GetPendingFilesByBucketID(bucketID)
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if err := fm.Delete(ctx, bucketID, p.StringID); err != nil {
+			return err
+		}
+	}
+
+	return s.fileRepo.DeleteUploadSession(bucketID)
+}
+
+// discardBucket drops a bucket row whose upload session could not be set up; no objects exist yet
+func (s *localFileService) discardBucket(bucketID string) {
+	if err := s.fileRepo.DeleteBucket(bucketID); err != nil {
+		slog.Error("failed to discard bucket", "bucket_id", bucketID, "error", err)
+	}
+}
+
+func generateUploadToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate upload token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// base64SHA256 converts a hex SHA-256 to the base64 form S3 uses for x-amz-checksum-sha256
+func base64SHA256(hexDigest string) string {
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(digest)
+}
+
+func hashUploadToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
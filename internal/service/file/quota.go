@@ -0,0 +1,182 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+// Quota caps what one uploader may store. A nil limit is unlimited.
+type Quota struct {
+	MaxBytes    *int64 `json:"max_bytes"`     // Total size of the uploader's files
+	MaxBuckets  *int64 `json:"max_buckets"`   // Buckets the uploader owns
+	MaxFileSize *int64 `json:"max_file_size"` // Size of any single file
+}
+
+// UsageReport is what a user stores, measured against their quota
+type UsageReport struct {
+	UserID  string `json:"user_id"`
+	Files   int64  `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Buckets int64  `json:"buckets"`
+	Quota   Quota  `json:"quota"`
+
+	RemainingBytes   *int64 `json:"remaining_bytes,omitempty"`   // Omitted when storage is unlimited
+	RemainingBuckets *int64 `json:"remaining_buckets,omitempty"` // Omitted when buckets are unlimited
+}
+
+// newQuota builds a quota from its configured values. 0 disables a limit; an invalid value keeps its default.
+func newQuota(storageMB, buckets, fileSizeMB string, defaults Quota) Quota {
+	return Quota{
+		MaxBytes:    parseQuotaLimit(storageMB, 1<<20, defaults.MaxBytes),
+		MaxBuckets:  parseQuotaLimit(buckets, 1, defaults.MaxBuckets),
+		MaxFileSize: parseQuotaLimit(fileSizeMB, 1<<20, defaults.MaxFileSize),
+	}
+}
+
+func parseQuotaLimit(value string, unit int64, fallback *int64) *int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return fallback
+	}
+	if n == 0 {
+		return nil
+	}
+	limit := n * unit
+	return &limit
+}
+
+func quotaLimit(n int64) *int64 {
+	return &n
+}
+
+// GetUsage reports the storage a user consumes and what their quota still allows
+func (s *localFileService) GetUsage(ctx context.Context, userID string) (*UsageReport, error) {
+	if userID == "" {
+		return nil, errors.New("user id is required")
+	}
+
+	usage, err := s.fileRepo.GetUserUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		UserID:  userID,
+		Files:   usage.Files,
+		Bytes:   usage.Bytes,
+		Buckets: usage.Buckets,
+		Quota:   s.userQuota,
+	}
+	if s.userQuota.MaxBytes != nil {
+		report.RemainingBytes = quotaLimit(max(*s.userQuota.MaxBytes-usage.Bytes, 0))
+	}
+	if s.userQuota.MaxBuckets != nil {
+		report.RemainingBuckets = quotaLimit(max(*s.userQuota.MaxBuckets-usage.Buckets, 0))
+	}
+	return report, nil
+}
+
+// uploadQuota is what an uploader's quota still allows during one upload request.
+// Concurrent uploads are each measured against the usage recorded when they started,
+// so together they can overshoot the quota by what they have in flight.
+type uploadQuota struct {
+	remaining   *int64 // Bytes left, nil = unlimited
+	maxFileSize *int64 // nil = unlimited
+	err         error  // Limit a streamed file ran into
+}
+
+// reserveQuota checks an upload against its uploader's quota before anything is written.
+// A logged-in upload is charged to userID, an anonymous one to clientIP. newBucket says whether
+// the upload creates a bucket, and freed is how many bytes it releases, such as those of a file it replaces.
+func (s *localFileService) reserveQuota(userID *string, clientIP string, newBucket bool, freed int64) (*uploadQuota, error) {
+	quota := s.anonymousQuota
+	var usage *local.Usage
+	var err error
+	if userID != nil && *userID != "" {
+		quota = s.userQuota
+		usage, err = s.fileRepo.GetUserUsage(*userID)
+	} else {
+		usage, err = s.fileRepo.GetAnonymousUsage(clientIP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if newBucket && quota.MaxBuckets != nil && usage.Buckets >= *quota.MaxBuckets {
+		return nil, ErrBucketQuotaExceeded
+	}
+
+	reserved := &uploadQuota{maxFileSize: quota.MaxFileSize}
+	if quota.MaxBytes != nil {
+		remaining := *quota.MaxBytes - usage.Bytes + freed
+		if remaining <= 0 {
+			return nil, ErrStorageQuotaExceeded
+		}
+		reserved.remaining = &remaining
+	}
+	return reserved, nil
+}
+
+// reserve charges a file whose size is declared up front
+func (q *uploadQuota) reserve(size int64) error {
+	if q.maxFileSize != nil && size > *q.maxFileSize {
+		return ErrFileTooLarge
+	}
+	if q.remaining != nil {
+		if size > *q.remaining {
+			return ErrStorageQuotaExceeded
+		}
+		*q.remaining -= size
+	}
+	return nil
+}
+
+// limit charges a streamed file as it is read. Reading fails once the file outgrows the quota,
+// and exceeded then reports which limit was hit.
+func (q *uploadQuota) limit(body io.Reader) io.Reader {
+	if q == nil || (q.remaining == nil && q.maxFileSize == nil) {
+		return body
+	}
+	return &quotaReader{quota: q, body: body}
+}
+
+// exceeded returns the limit a streamed file ran into, if any
+func (q *uploadQuota) exceeded() error {
+	if q == nil {
+		return nil
+	}
+	return q.err
+}
+
+type quotaReader struct {
+	quota *uploadQuota
+	body  io.Reader
+	read  int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	q := r.quota
+	if q.err != nil {
+		return 0, q.err
+	}
+
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if q.maxFileSize != nil && r.read > *q.maxFileSize {
+		q.err = ErrFileTooLarge
+	} else if q.remaining != nil {
+		*q.remaining -= int64(n)
+		if *q.remaining < 0 {
+			q.err = ErrStorageQuotaExceeded
+		}
+	}
+	if q.err != nil {
+		return n, q.err
+	}
+	return n, err
+}
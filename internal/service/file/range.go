@@ -0,0 +1,88 @@
+package file
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RangeNotSatisfiableError is returned when a Range header lies outside the file
+type RangeNotSatisfiableError struct {
+	Size int64
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("requested range not satisfiable for %d bytes", e.Size)
+}
+
+// parseByteRange resolves a Range header against a file of the given size.
+// Only a single "bytes=" range is honoured; anything else, including multiple ranges,
+// reports ok=false so the whole file is sent, which RFC 9110 allows.
+func parseByteRange(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	first = strings.TrimSpace(first)
+	last = strings.TrimSpace(last)
+
+	switch {
+	case first == "":
+		// Suffix range: the last N bytes
+		n, convErr := strconv.ParseInt(last, 10, 64)
+		if convErr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, &RangeNotSatisfiableError{Size: size}
+		}
+		start = max(size-n, 0)
+		end = size - 1
+	default:
+		var convErr error
+		start, convErr = strconv.ParseInt(first, 10, 64)
+		if convErr != nil || start < 0 {
+			return 0, 0, false, nil
+		}
+		end = size - 1
+		if last != "" {
+			end, convErr = strconv.ParseInt(last, 10, 64)
+			if convErr != nil || end < start {
+				return 0, 0, false, nil
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			return 0, 0, false, &RangeNotSatisfiableError{Size: size}
+		}
+	}
+
+	return start, end, true, nil
+}
+
+// ifRangeMatches reports whether an If-Range precondition still holds for a file last modified at modifiedAt
+// with the given hex SHA-256, if known. An empty header always matches; a date must equal the Last-Modified
+// value exactly, and an entity tag must be the file's strong ETag.
+func ifRangeMatches(header string, modifiedAt int64, sha256Hex *string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		// Weak tags never match for ranges (RFC 9110 section 13.1.5)
+		return sha256Hex != nil && header == ContentETag(*sha256Hex)
+	}
+
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return t.Equal(time.Unix(modifiedAt, 0))
+}
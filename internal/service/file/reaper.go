@@ -0,0 +1,36 @@
+package file
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RunBucketReaper purges expired buckets and stale upload sessions every interval until ctx is cancelled
+func RunBucketReaper(ctx context.Context, s FileService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The purges run independently, so a bucket that keeps failing to delete
+			// does not leave stale uploads holding quota behind it
+			purged, err := s.PurgeExpiredBuckets(ctx)
+			if err != nil {
+				slog.Error("bucket reaper failed", "error", err, "purged", purged)
+			} else if purged > 0 {
+				slog.Info("bucket reaper purged expired buckets", "purged", purged)
+			}
+
+			stale, err := s.PurgeStaleUploads(ctx)
+			if err != nil {
+				slog.Error("bucket reaper failed to purge upload sessions", "error", err, "purged", stale)
+			} else if stale > 0 {
+				slog.Info("bucket reaper purged stale upload sessions", "purged", stale)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/pkg"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// defaultShareLinkExpiry is how long a share link works when no expiry is given
+	defaultShareLinkExpiry = 7 * 24 * time.Hour
+	// maxShareLinkLabel caps the length of a share link label
+	maxShareLinkLabel = 200
+)
+
+// ShareLinkClaims are signed into a share link token. The link record decides whether the token still works.
+type ShareLinkClaims struct {
+	LinkID   string `json:"link_id"`
+	BucketID string `json:"bucket_id"`
+	FileID   string `json:"file_id"` // string_id of the shared file
+	jwt.RegisteredClaims
+}
+
+// ShareLinkOptions carries the settings of a new share link
+type ShareLinkOptions struct {
+	ExpiresAt    *int64 // Unix timestamp, nil = defaultShareLinkExpiry from now
+	MaxDownloads *int64 // nil = unlimited
+	Label        string
+}
+
+// ShareLink describes a share link to its bucket's admins
+type ShareLink struct {
+	ID            string  `json:"id"`
+	BucketID      string  `json:"bucket_id"`
+	FileID        string  `json:"file_id"`
+	Label         *string `json:"label,omitempty"`
+	URL           string  `json:"url"` // Download path with the signed link token
+	CreatedBy     string  `json:"created_by"`
+	CreatedAt     int64   `json:"created_at"`
+	ExpiresAt     int64   `json:"expires_at"`
+	MaxDownloads  *int64  `json:"max_downloads,omitempty"`
+	DownloadCount int64   `json:"download_count"`
+	Expired       bool    `json:"expired"` // Past its expiry or out of downloads
+}
+
+// CreateShareLink lets a bucket admin share one file of the bucket without its password
+func (s *localFileService) CreateShareLink(ctx context.Context, bucketID, stringID, userID string, opts ShareLinkOptions) (*ShareLink, error) {
+	if _, err := s.getAdministeredBucket(bucketID, userID); err != nil {
+		return nil, err
+	}
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultShareLinkExpiry).Unix()
+	if opts.ExpiresAt != nil {
+		if *opts.ExpiresAt <= now.Unix() {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		expiresAt = *opts.ExpiresAt
+	}
+	if opts.MaxDownloads != nil && *opts.MaxDownloads <= 0 {
+		return nil, errors.New("max_downloads must be a positive integer")
+	}
+
+	var label *string
+	if trimmed := strings.TrimSpace(opts.Label); trimmed != "" {
+		if len(trimmed) > maxShareLinkLabel {
+			return nil, fmt.Errorf("label must be at most %d characters", maxShareLinkLabel)
+		}
+		label = &trimmed
+	}
+
+	id, err := generateUploadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &local.ShareLink{
+		ID:           id,
+		BucketID:     bucketID,
+		FileID:       file.ID,
+		Label:        label,
+		CreatedBy:    userID,
+		CreatedAt:    now.Unix(),
+		ExpiresAt:    expiresAt,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if err := s.fileRepo.CreateShareLink(link); err != nil {
+		return nil, err
+	}
+
+	return newShareLink(link, file.StringID, now)
+}
+
+// ListShareLinks lists every share link of a file, expired ones included, for a bucket admin
+func (s *localFileService) ListShareLinks(ctx context.Context, bucketID, stringID, userID string) ([]*ShareLink, error) {
+	if _, err := s.getAdministeredBucket(bucketID, userID); err != nil {
+		return nil, err
+	}
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := s.fileRepo.GetShareLinksByFileID(file.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	shareLinks := make([]*ShareLink, 0, len(links))
+	for _, link := range links {
+		shareLink, err := newShareLink(link, file.StringID, now)
+		if err != nil {
+			return nil, err
+		}
+		shareLinks = append(shareLinks, shareLink)
+	}
+	return shareLinks, nil
+}
+
+// RevokeShareLink lets a bucket admin delete a share link, so its token stops working at once
+func (s *localFileService) RevokeShareLink(ctx context.Context, bucketID, stringID, linkID, userID string) error {
+	if _, err := s.getAdministeredBucket(bucketID, userID); err != nil {
+		return err
+	}
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return err
+	}
+
+	link, err := s.fileRepo.GetShareLinkByID(linkID)
+	if err != nil {
+		return err
+	}
+	if link == nil || link.FileID != file.ID {
+		return ErrShareLinkNotFound
+	}
+
+	return s.fileRepo.DeleteShareLink(link.ID)
+}
+
+// CheckShareLink checks a share link token against the file it is used for and the link's record,
+// and returns the link's ID. The download it grants is counted by DownloadFile, through DownloadOptions.ShareLinkID.
+func (s *localFileService) CheckShareLink(ctx context.Context, bucketID, stringID, token string) (string, error) {
+	claims, err := validateShareLinkToken(token)
+	if err != nil {
+		return "", err
+	}
+	if claims.BucketID != bucketID || claims.FileID != stringID {
+		return "", ErrInvalidShareLink
+	}
+
+	link, err := s.fileRepo.GetShareLinkByID(claims.LinkID)
+	if err != nil {
+		return "", err
+	}
+	if link == nil {
+		return "", ErrShareLinkNotFound
+	}
+
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return "", err
+	}
+	if link.BucketID != bucketID || link.FileID != file.ID {
+		return "", ErrInvalidShareLink
+	}
+
+	now := time.Now()
+	if now.Unix() >= link.ExpiresAt {
+		return "", ErrShareLinkExpired
+	}
+	if link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads {
+		return "", ErrDownloadLimitReached
+	}
+
+	bucket, err := s.fileRepo.GetBucketByID(bucketID)
+	if err != nil {
+		return "", err
+	}
+	if bucket == nil {
+		return "", ErrBucketNotFound
+	}
+	if bucketExpired(bucket, now) {
+		return "", ErrBucketExpired
+	}
+	return link.ID, nil
+}
+
+// consumeDownload counts a download of file, and of the share link it went through if any.
+// The link is counted first, so an exhausted link uses up none of the file's downloads.
+func (s *localFileService) consumeDownload(file *local.File, shareLinkID string) (int64, bool, error) {
+	if shareLinkID != "" {
+		ok, err := s.fileRepo.ConsumeShareLinkDownload(shareLinkID)
+		if err != nil || !ok {
+			return 0, ok, err
+		}
+	}
+	return s.fileRepo.ConsumeDownload(file.ID)
+}
+
+func newShareLink(link *local.ShareLink, stringID string, now time.Time) (*ShareLink, error) {
+	token, err := generateShareLinkToken(link, stringID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShareLink{
+		ID:            link.ID,
+		BucketID:      link.BucketID,
+		FileID:        stringID,
+		Label:         link.Label,
+		URL:           fmt.Sprintf("/files/s/%s/d/%s?link=%s", url.PathEscape(link.BucketID), url.PathEscape(stringID), url.QueryEscape(token)),
+		CreatedBy:     link.CreatedBy,
+		CreatedAt:     link.CreatedAt,
+		ExpiresAt:     link.ExpiresAt,
+		MaxDownloads:  link.MaxDownloads,
+		DownloadCount: link.DownloadCount,
+		Expired:       now.Unix() >= link.ExpiresAt || (link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads),
+	}, nil
+}
+
+// generateShareLinkToken signs a link's record. The claims only come from the record,
+// so listing the links hands out the same tokens they were created with.
+func generateShareLinkToken(link *local.ShareLink, stringID string) (string, error) {
+	jwtSecret := pkg.JWT_SECRET
+	if jwtSecret == "" {
+		return "", fmt.Errorf("JWT_SECRET environment variable is required")
+	}
+
+	claims := &ShareLinkClaims{
+		LinkID:   link.ID,
+		BucketID: link.BucketID,
+		FileID:   stringID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Unix(link.ExpiresAt, 0)),
+			IssuedAt:  jwt.NewNumericDate(time.Unix(link.CreatedAt, 0)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(jwtSecret))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign share link: %w", err)
+	}
+
+	return tokenString, nil
+}
+
+func validateShareLinkToken(tokenString string) (*ShareLinkClaims, error) {
+	jwtSecret := pkg.JWT_SECRET
+	if jwtSecret == "" {
+		return nil, fmt.Errorf("JWT_SECRET environment variable is required")
+	}
+
+	claims := &ShareLinkClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecret), nil
+	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrShareLinkExpired
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidShareLink
+	}
+
+	return claims, nil
+}
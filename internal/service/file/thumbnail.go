@@ -0,0 +1,206 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Registers the decoders used for thumbnail sources
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+
+	"github.com/cthulhu-platform/gateway/internal/microservices/filemanager"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// DefaultThumbnailWidth is used when a thumbnail request names no width
+const DefaultThumbnailWidth = 256
+
+const (
+	// maxThumbnailSourceSize caps the files read into memory to render a thumbnail
+	maxThumbnailSourceSize = 50 << 20
+	// maxThumbnailSourcePixels caps the decoded size of a thumbnail source, guarding against decompression bombs.
+	// A decoded image takes up to 4 bytes a pixel, so this is 64 MiB, enough for a 4096x4096 photo.
+	maxThumbnailSourcePixels = 4096 * 4096
+	// maxConcurrentThumbnails caps renders running at once, each of which holds a source and its decoded image
+	maxConcurrentThumbnails = 4
+	thumbnailQuality        = 80
+	thumbnailContentType    = "image/jpeg"
+)
+
+// thumbnailWidths are the widths thumbnails are rendered at. A requested width is rounded up to
+// the next one, so the cache holds a handful of sizes per file rather than one per distinct request.
+var thumbnailWidths = []int{64, 128, 256, 512, 1024}
+
+// thumbnailSourceTypes are the image types thumbnails can be rendered from
+var thumbnailSourceTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Thumbnail returns a JPEG preview of an image file, scaled down to width (rounded up to a supported size).
+// Rendered thumbnails are cached in S3 under thumbs/<bucket_id>/ and do not count as downloads,
+// which is why files with a download limit have none.
+func (s *localFileService) Thumbnail(ctx context.Context, bucketID, stringID string, width int) (*filemanager.DownloadResult, error) {
+	if bucketID == "" || stringID == "" {
+		return nil, errors.New("storage id and string id are required")
+	}
+
+	file, err := s.getBucketFile(bucketID, stringID)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(file.ContentType)
+	if !thumbnailSourceTypes[mediaType] {
+		return nil, ErrThumbnailUnsupported
+	}
+	if file.MaxDownloads != nil {
+		return nil, ErrThumbnailUnavailable
+	}
+	if file.Size > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("%w: image is too large", ErrThumbnailUnsupported)
+	}
+
+	fm := s.filemanager()
+	if fm == nil {
+		return nil, errors.New("filemanager connection not configured")
+	}
+
+	width = thumbnailWidth(width)
+	storageID := thumbnailStorageID(bucketID)
+	name := thumbnailName(file.StringID, width)
+
+	cached, err := fm.Head(ctx, storageID, name)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		res, err := fm.Download(ctx, storageID, name)
+		if err != nil {
+			return nil, err
+		}
+		res.ContentType = thumbnailContentType
+		res.AcceptRanges = false
+		res.LastModified = file.CreatedAt
+		return res, nil
+	}
+
+	// Renders are refused rather than queued when all slots are taken, so a burst of
+	// uncached thumbnails cannot hold memory for every request waiting behind it
+	select {
+	case s.thumbnailRenders <- struct{}{}:
+	default:
+		return nil, ErrThumbnailBusy
+	}
+	data, err := renderThumbnail(ctx, fm, file, width)
+	<-s.thumbnailRenders
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed cache write only means the next request renders the thumbnail again
+	if err := fm.UploadSingleObject(ctx, storageID, name, filemanager.UploadObject{
+		Name:        name,
+		Size:        int64(len(data)),
+		ContentType: thumbnailContentType,
+		Body:        bytes.NewReader(data),
+	}); err != nil {
+		slog.Error("failed to cache thumbnail", "bucket_id", bucketID, "string_id", file.StringID, "error", err)
+	}
+
+	return &filemanager.DownloadResult{
+		Body:           io.NopCloser(bytes.NewReader(data)),
+		ContentType:    thumbnailContentType,
+		ContentLength:  int64(len(data)),
+		DownloadedFile: name,
+		LastModified:   file.CreatedAt,
+	}, nil
+}
+
+// renderThumbnail decodes an image file and encodes it as a JPEG at most width pixels wide
+func renderThumbnail(ctx context.Context, fm filemanager.FilemanagerConnection, file *local.File, width int) ([]byte, error) {
+	objectStorageID, objectName, err := splitS3Key(file.S3Key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := fm.Download(ctx, objectStorageID, objectName)
+	if err != nil {
+		return nil, err
+	}
+	source, err := io.ReadAll(io.LimitReader(obj.Body, maxThumbnailSourceSize+1))
+	obj.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(source) > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("%w: image is too large", ErrThumbnailUnsupported)
+	}
+
+	// The header is checked first so a huge canvas is refused before it is allocated
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrThumbnailUnsupported, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("%w: image dimensions are too large", ErrThumbnailUnsupported)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrThumbnailUnsupported, err)
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, scaleToWidth(img, width), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// scaleToWidth shrinks img to width pixels keeping its aspect ratio; smaller images keep their size.
+// JPEG has no alpha channel, so transparent areas are flattened onto white.
+func scaleToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	width = min(width, bounds.Dx())
+	height := max(bounds.Dy()*width/bounds.Dx(), 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// thumbnailWidth rounds a requested width up to the nearest rendered size
+func thumbnailWidth(width int) int {
+	for _, w := range thumbnailWidths {
+		if width <= w {
+			return w
+		}
+	}
+	return thumbnailWidths[len(thumbnailWidths)-1]
+}
+
+// deleteThumbnails removes the cached thumbnails of a file; failures only leave stale cache entries behind
+func deleteThumbnails(ctx context.Context, fm filemanager.FilemanagerConnection, bucketID, stringID string) {
+	for _, width := range thumbnailWidths {
+		if err := fm.Delete(ctx, thumbnailStorageID(bucketID), thumbnailName(stringID, width)); err != nil {
+			slog.Error("failed to delete thumbnail", "bucket_id", bucketID, "string_id", stringID, "error", err)
+		}
+	}
+}
+
+func thumbnailStorageID(bucketID string) string {
+	return "thumbs/" + bucketID
+}
+
+func thumbnailName(stringID string, width int) string {
+	return fmt.Sprintf("%s-%d.jpg", stringID, width)
+}
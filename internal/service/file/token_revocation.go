@@ -0,0 +1,221 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+)
+
+const (
+	// revocationCacheTTL is how long a lookup of a token that was not revoked is trusted.
+	// Revocations made by this process apply at once; those made by another instance
+	// take up to this long to reach it.
+	revocationCacheTTL = 10 * time.Second
+	// revocationCacheSize is the number of cached lookups past which stale ones are dropped
+	revocationCacheSize = 10000
+)
+
+// BucketTokenInfo describes an active bucket access token to the bucket's admins
+type BucketTokenInfo struct {
+	ID         string   `json:"id"` // jti of the token
+	UserID     *string  `json:"user_id,omitempty"`
+	Privileges []string `json:"privileges"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at"`
+}
+
+// issueBucketAccessToken signs a token for bucket and records its jti so it can be revoked
+func (s *localFileService) issueBucketAccessToken(bucket *local.Bucket, userID *string, authTokenID *string, privileges []string) (string, error) {
+	token, claims, err := GenerateBucketAccessToken(bucket.ID, bucket.PasswordVersion, userID, authTokenID, privileges)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate bucket access token: %w", err)
+	}
+
+	record := &local.BucketToken{
+		ID:         claims.ID,
+		BucketID:   bucket.ID,
+		UserID:     userID,
+		Privileges: privileges,
+		CreatedAt:  claims.IssuedAt.Unix(),
+		ExpiresAt:  claims.ExpiresAt.Unix(),
+	}
+	if err := s.fileRepo.CreateBucketToken(record); err != nil {
+		return "", fmt.Errorf("failed to record bucket access token: %w", err)
+	}
+
+	return token, nil
+}
+
+// CheckBucketToken reports ErrBucketTokenRevoked unless tokenID is an issued, unrevoked token of the bucket
+func (s *localFileService) CheckBucketToken(ctx context.Context, bucketID, tokenID string) error {
+	if tokenID == "" {
+		return ErrBucketTokenRevoked
+	}
+
+	if revoked, ok := s.tokenRevocations.lookup(bucketID, tokenID); ok {
+		if revoked {
+			return ErrBucketTokenRevoked
+		}
+		return nil
+	}
+
+	token, err := s.fileRepo.GetBucketToken(tokenID)
+	if err != nil {
+		return err
+	}
+	// A token that was never recorded counts as revoked, so tokens cannot outlive their records
+	if token == nil {
+		return ErrBucketTokenRevoked
+	}
+	s.tokenRevocations.store(token.BucketID, token.ID, token.RevokedAt != nil, token.ExpiresAt)
+
+	if token.BucketID != bucketID || token.RevokedAt != nil {
+		return ErrBucketTokenRevoked
+	}
+	return nil
+}
+
+// ListBucketTokens lists the active access tokens of a bucket for one of its admins
+func (s *localFileService) ListBucketTokens(ctx context.Context, bucketID, userID string) ([]BucketTokenInfo, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.fileRepo.GetActiveBucketTokens(bucket.ID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]BucketTokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		infos = append(infos, BucketTokenInfo{
+			ID:         token.ID,
+			UserID:     token.UserID,
+			Privileges: token.Privileges,
+			CreatedAt:  token.CreatedAt,
+			ExpiresAt:  token.ExpiresAt,
+		})
+	}
+	return infos, nil
+}
+
+// RevokeBucketToken lets a bucket admin cut off one access token before it expires
+func (s *localFileService) RevokeBucketToken(ctx context.Context, bucketID, tokenID, userID string) error {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := s.fileRepo.RevokeBucketToken(bucket.ID, tokenID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrBucketTokenNotFound
+	}
+
+	s.tokenRevocations.revoke(bucket.ID, tokenID)
+	return nil
+}
+
+// RevokeBucketTokens lets a bucket admin cut off every access token of the bucket, returning how many were active
+func (s *localFileService) RevokeBucketTokens(ctx context.Context, bucketID, userID string) (int64, error) {
+	bucket, err := s.getAdministeredBucket(bucketID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := s.fileRepo.RevokeBucketTokens(bucket.ID, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	s.tokenRevocations.revokeBucket(bucket.ID)
+	return revoked, nil
+}
+
+// revocationCache remembers recent revocation lookups so BucketPasswordAuth
+// does not query the database on every request
+type revocationCache struct {
+	mu      sync.Mutex
+	entries map[string]revocationEntry // jti -> last lookup
+}
+
+type revocationEntry struct {
+	bucketID  string
+	revoked   bool
+	checkedAt time.Time
+	expiresAt int64 // Unix timestamp after which the token is rejected anyway
+}
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{entries: make(map[string]revocationEntry)}
+}
+
+// lookup returns the cached state of a token; ok is false when it must be looked up again
+func (c *revocationCache) lookup(bucketID, tokenID string) (revoked bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[tokenID]
+	if !found || entry.bucketID != bucketID {
+		return false, false
+	}
+	// Revocation is permanent, so only unrevoked lookups go stale
+	if !entry.revoked && time.Since(entry.checkedAt) >= revocationCacheTTL {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *revocationCache) store(bucketID, tokenID string, revoked bool, expiresAt int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= revocationCacheSize {
+		c.prune()
+	}
+	c.entries[tokenID] = revocationEntry{
+		bucketID:  bucketID,
+		revoked:   revoked,
+		checkedAt: time.Now(),
+		expiresAt: expiresAt,
+	}
+}
+
+func (c *revocationCache) revoke(bucketID, tokenID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[tokenID]
+	if found && entry.bucketID == bucketID {
+		entry.revoked = true
+		c.entries[tokenID] = entry
+	}
+}
+
+func (c *revocationCache) revokeBucket(bucketID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for tokenID, entry := range c.entries {
+		if entry.bucketID == bucketID {
+			entry.revoked = true
+			c.entries[tokenID] = entry
+		}
+	}
+}
+
+// prune drops the entries of expired tokens and unrevoked lookups past their TTL. Must hold mu.
+func (c *revocationCache) prune() {
+	now := time.Now()
+	for tokenID, entry := range c.entries {
+		if now.Unix() >= entry.expiresAt || (!entry.revoked && now.Sub(entry.checkedAt) >= revocationCacheTTL) {
+			delete(c.entries, tokenID)
+		}
+	}
+}
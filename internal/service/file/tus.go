@@ -0,0 +1,552 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cthulhu-platform/gateway/internal/pkg"
+	"github.com/cthulhu-platform/gateway/internal/repository/local"
+	"github.com/google/uuid"
+)
+
+// TusChecksumAlgorithms lists the Upload-Checksum algorithms accepted by WriteTusChunk
+var TusChecksumAlgorithms = []string{"sha1", "sha256", "md5"}
+
+// TusCreateOptions describes a new resumable upload
+type TusCreateOptions struct {
+	Length      int64 // Total size in bytes from Upload-Length
+	FileName    string
+	ContentType string
+	Metadata    string              // Upload-Metadata to echo back on HEAD, without secrets
+	BucketID    string              // Existing bucket to add the file to; empty creates a bucket once complete
+	Claims      *BucketAccessClaims // Validated X-Bucket-Access token for BucketID, nil when none was sent
+	Upload      UploadOptions       // Settings of the bucket created once complete
+}
+
+// TusChecksum is a parsed Upload-Checksum header
+type TusChecksum struct {
+	Algorithm string
+	Digest    []byte
+}
+
+// TusUpload reports the state of a resumable upload
+type TusUpload struct {
+	ID       string
+	Offset   int64
+	Length   int64
+	Metadata string
+	BucketID string // Set once the upload is stored as a file
+	StringID string // Set once the upload is stored as a file
+	Error    string // Why storing the complete upload last failed; it is tried again
+}
+
+// CreateTusUpload registers a resumable upload and stages an empty file for it on disk.
+// A zero-length upload is complete straight away.
+func (s *localFileService) CreateTusUpload(ctx context.Context, userID *string, clientIP string, opts TusCreateOptions) (*TusUpload, error) {
+	if opts.Length < 0 {
+		return nil, errors.New("upload length must not be negative")
+	}
+	if opts.Length > s.tusMaxSize {
+		return nil, ErrFileTooLarge
+	}
+	if opts.FileName == "" {
+		return nil, errors.New("filename metadata is required")
+	}
+	if _, _, err := splitFilePath(opts.FileName); err != nil {
+		return nil, err
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+
+	now := time.Now()
+	upload := &local.TusUpload{
+		ID:          uuid.New().String(),
+		Length:      opts.Length,
+		Metadata:    opts.Metadata,
+		FileName:    opts.FileName,
+		ContentType: opts.ContentType,
+		OwnerID:     userID,
+		CreatedAt:   now.Unix(),
+		UpdatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(s.tusUploadExpiry).Unix(),
+	}
+
+	if opts.BucketID != "" {
+		// Adding to an existing bucket follows the rules of AddFiles
+		bucket, err := s.fileRepo.GetBucketByID(opts.BucketID)
+		if err != nil {
+			return nil, err
+		}
+		if bucket == nil {
+			return nil, ErrBucketNotFound
+		}
+		if bucketExpired(bucket, now) {
+			return nil, ErrBucketExpired
+		}
+		access := BucketAccess{Claims: opts.Claims}
+		if userID != nil {
+			access.UserID = *userID
+		}
+		if err := s.requireBucketPrivilege(bucket.ID, access, PrivilegeWrite); err != nil {
+			return nil, err
+		}
+
+		// The file is charged to whoever AddFiles would charge
+		userID, clientIP = bucketPayer(bucket, access)
+		upload.OwnerID = userID
+		if userID == nil && clientIP != "" {
+			upload.ClientIP = &clientIP
+		}
+		upload.BucketID = &bucket.ID
+		upload.MaxDownloads = bucket.DefaultMaxDownloads
+	} else {
+		limits := resolveDownloadLimits(1, opts.Upload.DefaultMaxDownloads, opts.Upload.FileMaxDownloads)
+		if err := checkUploadOptions(opts.Upload, limits, now.Unix()); err != nil {
+			return nil, err
+		}
+
+		// The password is hashed now so it is never stored in plain text while the upload is open
+		if opts.Upload.Password != nil && *opts.Upload.Password != "" {
+			hash, err := HashPassword(*opts.Upload.Password)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash password: %w", err)
+			}
+			upload.PasswordHash = &hash
+		}
+		upload.BucketExpiresAt = opts.Upload.ExpiresAt
+		upload.MaxDownloads = limits[0]
+		upload.BurnAfterReading = opts.Upload.BurnAfterReading
+		title, description, labels, err := normalizeBucketDetails(opts.Upload)
+		if err != nil {
+			return nil, err
+		}
+		upload.BucketTitle, upload.BucketDescription, upload.BucketLabels = title, description, labels
+		if userID == nil && clientIP != "" {
+			upload.ClientIP = &clientIP
+		}
+	}
+
+	// The declared length is charged now, before any bytes are staged
+	quota, err := s.reserveQuota(userID, clientIP, upload.BucketID == nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := quota.reserve(opts.Length); err != nil {
+		return nil, err
+	}
+
+	if err := s.stageTusUpload(upload); err != nil {
+		return nil, err
+	}
+
+	if upload.Length == 0 {
+		if err := s.finishTusUpload(ctx, upload); err != nil {
+			if discardErr := s.discardTusUpload(upload); discardErr != nil {
+				slog.Error("failed to discard tus upload", "upload_id", upload.ID, "error", discardErr)
+			}
+			return nil, err
+		}
+	}
+
+	return newTusUpload(upload), nil
+}
+
+// stageTusUpload records a new upload and creates the empty file its bytes are staged in,
+// unless the uploads already staged leave no room for its declared length
+func (s *localFileService) stageTusUpload(upload *local.TusUpload) error {
+	s.tusStaging.Lock()
+	defer s.tusStaging.Unlock()
+
+	staged, err := s.fileRepo.GetTusStagingBytes()
+	if err != nil {
+		return err
+	}
+	if staged+upload.Length > s.tusStagingMax {
+		return ErrTusStagingFull
+	}
+
+	if err := os.MkdirAll(tusStagingDir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(tusStagingPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := s.fileRepo.CreateTusUpload(upload); err != nil {
+		os.Remove(tusStagingPath(upload.ID))
+		return err
+	}
+	return nil
+}
+
+// GetTusUpload reports an upload. A complete upload whose file is not stored yet, and is not being
+// stored, failed or was cut short by a restart, so storing it starts again.
+func (s *localFileService) GetTusUpload(ctx context.Context, id string) (*TusUpload, error) {
+	upload, err := s.fileRepo.GetTusUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil {
+		return nil, ErrTusUploadNotFound
+	}
+
+	res := newTusUpload(upload)
+	if upload.Offset == upload.Length && upload.StringID == nil {
+		if err, ok := s.tusFinishErrors.Load(id); ok {
+			res.Error = err.(error).Error()
+		}
+		if unlock, ok := s.lockTusUpload(id); ok {
+			// Read again under the lock, as a finish may have just completed
+			if upload, err = s.fileRepo.GetTusUpload(id); err != nil || upload == nil || upload.StringID != nil {
+				unlock()
+			} else {
+				s.finishTusUploadInBackground(upload, unlock)
+			}
+		}
+	}
+	return res, nil
+}
+
+// WriteTusChunk appends body to an upload at offset, which must match the bytes received so far.
+// Without a checksum, whatever arrived before a broken connection is kept so the client can resume;
+// with one, the chunk is only kept when its digest matches. Once the last byte arrives the upload
+// is stored as a file in the background, and GetTusUpload reports the file when it is done.
+func (s *localFileService) WriteTusChunk(ctx context.Context, id string, offset int64, body io.Reader, checksum *TusChecksum) (*TusUpload, error) {
+	unlock, ok := s.lockTusUpload(id)
+	if !ok {
+		return nil, ErrTusUploadLocked
+	}
+	defer func() {
+		// Handed over to the background finish once the upload is complete
+		if unlock != nil {
+			unlock()
+		}
+	}()
+
+	upload, err := s.fileRepo.GetTusUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil {
+		return nil, ErrTusUploadNotFound
+	}
+	if offset != upload.Offset {
+		return nil, ErrTusOffsetMismatch
+	}
+	if upload.StringID != nil {
+		return newTusUpload(upload), nil
+	}
+
+	var digest hash.Hash
+	if checksum != nil {
+		if digest = newTusChecksumHash(checksum.Algorithm); digest == nil {
+			return nil, ErrTusUnsupportedChecksum
+		}
+	}
+
+	n, writeErr := writeTusChunk(tusStagingPath(upload.ID), offset, upload.Length-offset, body, digest)
+	if writeErr == nil && digest != nil && !bytes.Equal(digest.Sum(nil), checksum.Digest) {
+		writeErr = ErrTusChecksumMismatch
+	}
+	if writeErr != nil && (checksum != nil || errors.Is(writeErr, ErrTusChunkTooLarge)) {
+		// The chunk is rejected as a whole, so drop whatever part of it was written
+		if err := os.Truncate(tusStagingPath(upload.ID), offset); err != nil {
+			slog.Error("failed to discard tus chunk", "upload_id", upload.ID, "error", err)
+		}
+		return nil, writeErr
+	}
+
+	now := time.Now()
+	upload.Offset += n
+	upload.UpdatedAt = now.Unix()
+	upload.ExpiresAt = now.Add(s.tusUploadExpiry).Unix()
+
+	if err := s.fileRepo.UpdateTusUpload(upload); err != nil {
+		return nil, err
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	res := newTusUpload(upload)
+	if upload.Offset == upload.Length {
+		// Storing the file takes as long as sending it to S3, far longer than clients wait for a response
+		s.finishTusUploadInBackground(upload, unlock)
+		unlock = nil
+	}
+	return res, nil
+}
+
+// finishTusUploadInBackground stores a complete upload as a file, holding its lock until done.
+// A failure is kept for GetTusUpload to report, which also starts the next attempt.
+func (s *localFileService) finishTusUploadInBackground(upload *local.TusUpload, unlock func()) {
+	go func() {
+		defer unlock()
+		if err := s.finishTusUpload(context.Background(), upload); err != nil {
+			slog.Error("failed to store tus upload", "upload_id", upload.ID, "error", err)
+			s.tusFinishErrors.Store(upload.ID, err)
+			return
+		}
+		s.tusFinishErrors.Delete(upload.ID)
+	}()
+}
+
+// TerminateTusUpload discards an upload and its staged bytes. A file already stored from it stays in its bucket.
+func (s *localFileService) TerminateTusUpload(ctx context.Context, id string) error {
+	unlock, ok := s.lockTusUpload(id)
+	if !ok {
+		return ErrTusUploadLocked
+	}
+	defer unlock()
+
+	upload, err := s.fileRepo.GetTusUpload(id)
+	if err != nil {
+		return err
+	}
+	if upload == nil {
+		return ErrTusUploadNotFound
+	}
+
+	return s.discardTusUpload(upload)
+}
+
+// finishTusUpload streams a complete upload from disk to S3 and records it through the
+// same bucket and file rows as a multipart upload
+func (s *localFileService) finishTusUpload(ctx context.Context, upload *local.TusUpload) error {
+	fm := s.filemanager()
+	if fm == nil {
+		return errors.New("filemanager connection not configured")
+	}
+
+	now := time.Now().Unix()
+	newBucket := upload.BucketID == nil
+
+	var storageID string
+	if newBucket {
+		id, err := s.reserveStorageID()
+		if err != nil {
+			return err
+		}
+		storageID = id
+	} else {
+		storageID = *upload.BucketID
+		bucket, err := s.fileRepo.GetBucketByID(storageID)
+		if err != nil {
+			return err
+		}
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+		if bucketExpired(bucket, time.Now()) {
+			return ErrBucketExpired
+		}
+	}
+
+	stringID := s.generateUniqueStringID(ctx)
+	if stringID == "" {
+		return errors.New("failed to generate unique string_id")
+	}
+
+	staged, err := os.Open(tusStagingPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	detected, body, err := sniffContentType(upload.FileName, upload.ContentType, staged)
+	if err != nil {
+		staged.Close()
+		return err
+	}
+	blob, err := s.storeBlob(ctx, fm, detected.contentType, body, "")
+	staged.Close()
+	if err != nil {
+		return err
+	}
+
+	file := stagedFile{
+		stringID: stringID,
+		name:     upload.FileName,
+		detected: detected,
+		size:     blob.size,
+		sha256:   blob.sha256,
+		s3Key:    blob.s3Key,
+	}
+
+	if newBucket {
+		bucket := &local.Bucket{
+			ID:           storageID,
+			PasswordHash: upload.PasswordHash,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+			ExpiresAt:    upload.BucketExpiresAt,
+
+			DefaultMaxDownloads: upload.MaxDownloads,
+			BurnAfterReading:    upload.BurnAfterReading,
+			UploaderIP:          upload.ClientIP,
+
+			Title:       upload.BucketTitle,
+			Description: upload.BucketDescription,
+			Labels:      upload.BucketLabels,
+		}
+		if err := s.storeBucket(bucket, upload.OwnerID); err != nil {
+			s.discardStaged(ctx, []stagedFile{file})
+			return err
+		}
+	}
+
+	if _, _, err := s.recordFiles(storageID, []stagedFile{file}, []*int64{upload.MaxDownloads}, upload.OwnerID, now); err != nil {
+		s.discardStaged(ctx, []stagedFile{file})
+		if newBucket {
+			if purgeErr := s.purgeBucket(ctx, storageID); purgeErr != nil {
+				slog.Error("failed to clean up tus upload", "bucket_id", storageID, "error", purgeErr)
+			}
+		}
+		return err
+	}
+
+	// The row is kept until it expires so a client that lost the final response can still see the result
+	upload.BucketID = &storageID
+	upload.StringID = &stringID
+	if err := s.fileRepo.UpdateTusUpload(upload); err != nil {
+		return err
+	}
+
+	if err := os.Remove(tusStagingPath(upload.ID)); err != nil {
+		slog.Error("failed to remove staged tus upload", "upload_id", upload.ID, "error", err)
+	}
+
+	return nil
+}
+
+// purgeStaleTusUploads discards uploads that have not been written to before their expiry.
+// Uploads busy with a request are left for the next run.
+func (s *localFileService) purgeStaleTusUploads(ctx context.Context) (int, error) {
+	uploads, err := s.fileRepo.GetExpiredTusUploads(time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	var firstErr error
+	for _, upload := range uploads {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+
+		unlock, ok := s.lockTusUpload(upload.ID)
+		if !ok {
+			continue
+		}
+		err := s.discardTusUpload(upload)
+		unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to purge tus upload %s: %w", upload.ID, err)
+			}
+			continue
+		}
+		purged++
+	}
+
+	return purged, firstErr
+}
+
+func (s *localFileService) discardTusUpload(upload *local.TusUpload) error {
+	if err := os.Remove(tusStagingPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := s.fileRepo.DeleteTusUpload(upload.ID); err != nil {
+		return err
+	}
+	s.tusLocks.Delete(upload.ID)
+	s.tusFinishErrors.Delete(upload.ID)
+	return nil
+}
+
+// writeTusChunk writes at most limit bytes of body into path at offset, feeding them to digest when set.
+// It returns the number of bytes written, and ErrTusChunkTooLarge when body holds more than limit.
+func writeTusChunk(path string, offset, limit int64, body io.Reader, digest hash.Hash) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = io.NewOffsetWriter(f, offset)
+	if digest != nil {
+		w = io.MultiWriter(w, digest)
+	}
+
+	n, copyErr := io.Copy(w, io.LimitReader(body, limit))
+	if copyErr == nil {
+		var extra [1]byte
+		if m, _ := io.ReadFull(body, extra[:]); m > 0 {
+			copyErr = ErrTusChunkTooLarge
+		}
+	}
+
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return n, copyErr
+}
+
+func newTusChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	default:
+		return nil
+	}
+}
+
+func newTusUpload(upload *local.TusUpload) *TusUpload {
+	res := &TusUpload{
+		ID:       upload.ID,
+		Offset:   upload.Offset,
+		Length:   upload.Length,
+		Metadata: upload.Metadata,
+	}
+	if upload.StringID != nil && upload.BucketID != nil {
+		res.BucketID = *upload.BucketID
+		res.StringID = *upload.StringID
+	}
+	return res
+}
+
+// lockTusUpload takes the write lock of an upload without waiting; ok is false when it is held
+func (s *localFileService) lockTusUpload(id string) (unlock func(), ok bool) {
+	v, _ := s.tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func tusStagingDir() string {
+	return filepath.Join(pkg.FILE_FOLDER, "tus")
+}
+
+func tusStagingPath(id string) string {
+	return filepath.Join(tusStagingDir(), id)
+}